@@ -0,0 +1,163 @@
+package artifacts
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Format of the artifacts archive.
+type Format string
+
+// available archive formats.
+const (
+	// FormatZip zip archive which keeps modes, modification times and symlinks of the files.
+	FormatZip Format = "zip"
+	// FormatGzip concatenated gzip streams, one per file, the file name is stored in the gzip header.
+	FormatGzip Format = "gzip"
+)
+
+// Extension returns extension of the archive file.
+func (f Format) Extension() string {
+	switch f {
+	case FormatZip:
+		return ".zip"
+	case FormatGzip:
+		return ".gz"
+	default:
+		return ""
+	}
+}
+
+// Archive writes the files of the directory into the archive of the specified format.
+// Files which are outside of the directory, directly or through a symlinked parent, are rejected.
+func Archive(w io.Writer, dir string, files []string, format Format) error {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return fmt.Errorf("resolve dir: %w", err)
+	}
+
+	switch format {
+	case FormatZip:
+		return archiveZip(w, root, files)
+	case FormatGzip:
+		return archiveGzip(w, root, files)
+	default:
+		return fmt.Errorf("unsupported archive format: %q", format)
+	}
+}
+
+// archiveZip writes zip archive of the files.
+func archiveZip(w io.Writer, root string, files []string) error {
+	archive := zip.NewWriter(w)
+
+	for _, file := range files {
+		if err := addZipFile(archive, root, file); err != nil {
+			return fmt.Errorf("add %s: %w", file, err)
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return fmt.Errorf("close zip: %w", err)
+	}
+
+	return nil
+}
+
+// addZipFile adds the file or symlink to the zip archive.
+func addZipFile(archive *zip.Writer, root, file string) error {
+	path, err := securePath(root, file)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return fmt.Errorf("file header: %w", err)
+	}
+
+	header.Name = file
+
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return fmt.Errorf("read link: %w", err)
+		}
+
+		w, err := archive.CreateHeader(header)
+		if err != nil {
+			return fmt.Errorf("create header: %w", err)
+		}
+
+		_, err = io.WriteString(w, target)
+
+		return err
+	case info.Mode().IsRegular():
+		header.Method = zip.Deflate
+
+		w, err := archive.CreateHeader(header)
+		if err != nil {
+			return fmt.Errorf("create header: %w", err)
+		}
+
+		return copyFile(w, path)
+	default:
+		// sockets, devices and other special files can't be archived.
+		return nil
+	}
+}
+
+// archiveGzip writes gzip stream of every regular file one by one.
+func archiveGzip(w io.Writer, root string, files []string) error {
+	for _, file := range files {
+		path, err := securePath(root, file)
+		if err != nil {
+			return fmt.Errorf("add %s: %w", file, err)
+		}
+
+		info, err := os.Lstat(path)
+		if err != nil {
+			return fmt.Errorf("stat %s: %w", file, err)
+		}
+
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		gz := gzip.NewWriter(w)
+		gz.Name = file
+		gz.ModTime = info.ModTime()
+
+		if err := copyFile(gz, path); err != nil {
+			return fmt.Errorf("add %s: %w", file, err)
+		}
+
+		if err := gz.Close(); err != nil {
+			return fmt.Errorf("close gzip: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// copyFile copies content of the file into the writer.
+func copyFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+
+	return err
+}
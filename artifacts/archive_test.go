@@ -0,0 +1,106 @@
+package artifacts
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchive_zip(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, "bin/app", "README.md")
+	assert.NoError(t, os.Chmod(filepath.Join(dir, "bin", "app"), 0o755))
+	assert.NoError(t, os.Symlink("bin/app", filepath.Join(dir, "app")))
+
+	var buf bytes.Buffer
+	assert.NoError(t, Archive(&buf, dir, []string{"README.md", "app", "bin/app"}, FormatZip))
+
+	archive, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if !assert.NoError(t, err) || !assert.Len(t, archive.File, 3) {
+		return
+	}
+
+	for _, file := range archive.File {
+		r, err := file.Open()
+		assert.NoError(t, err)
+
+		content, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		r.Close()
+
+		switch file.Name {
+		case "README.md":
+			assert.Equal(t, "README.md", string(content))
+			assert.Equal(t, os.FileMode(0o644), file.Mode())
+		case "bin/app":
+			assert.Equal(t, "bin/app", string(content))
+			assert.Equal(t, os.FileMode(0o755), file.Mode())
+		case "app":
+			assert.Equal(t, "bin/app", string(content))
+			assert.True(t, file.Mode()&os.ModeSymlink != 0)
+		default:
+			t.Errorf("unexpected file %s", file.Name)
+		}
+	}
+}
+
+func TestArchive_gzip(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, "reports/unit.xml", "reports/e2e.xml")
+
+	var buf bytes.Buffer
+	assert.NoError(t, Archive(&buf, dir, []string{"reports/e2e.xml", "reports/unit.xml"}, FormatGzip))
+
+	r := bufio.NewReader(&buf)
+
+	gz, err := gzip.NewReader(r)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	var names []string
+
+	for {
+		gz.Multistream(false)
+
+		content, err := ioutil.ReadAll(gz)
+		assert.NoError(t, err)
+		assert.Equal(t, gz.Name, string(content))
+
+		names = append(names, gz.Name)
+
+		if err := gz.Reset(r); err == io.EOF {
+			break
+		} else if !assert.NoError(t, err) {
+			return
+		}
+	}
+
+	assert.Equal(t, []string{"reports/e2e.xml", "reports/unit.xml"}, names)
+}
+
+func TestArchive_outside(t *testing.T) {
+	outside := t.TempDir()
+	writeFiles(t, outside, "secret")
+
+	dir := t.TempDir()
+	assert.NoError(t, os.Symlink(outside, filepath.Join(dir, "link")))
+
+	for _, format := range []Format{FormatZip, FormatGzip} {
+		for _, file := range []string{"link/secret", "../" + filepath.Base(outside) + "/secret"} {
+			assert.Error(t, Archive(ioutil.Discard, dir, []string{file}, format), file)
+		}
+	}
+}
+
+func TestArchive_unsupportedFormat(t *testing.T) {
+	assert.Error(t, Archive(ioutil.Discard, t.TempDir(), nil, Format("tar")))
+}
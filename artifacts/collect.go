@@ -0,0 +1,183 @@
+// Package artifacts collects job artifacts and packs them into archives.
+package artifacts
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+)
+
+// Options of the artifacts collection.
+type Options struct {
+	// Paths glob patterns of the files and directories relative to the project directory.
+	Paths []string
+	// Exclude glob patterns of the files which must not be collected.
+	Exclude []string
+	// Untracked collects all files which are not tracked by git.
+	Untracked bool
+}
+
+// Collect returns sorted paths of the files in the directory which match the options,
+// matched directories are collected with all their content. Paths are relative to the directory
+// and use forward slashes. Symlinks are collected as is, the files behind the symlinked directories
+// are not collected since they may be outside of the directory.
+func Collect(ctx context.Context, dir string, options Options) ([]string, error) {
+	fsys := os.DirFS(dir)
+	files := make(map[string]struct{})
+
+	for _, pattern := range options.Paths {
+		pattern, err := relativePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		matches, err := doublestar.Glob(fsys, pattern)
+		if err != nil {
+			return nil, fmt.Errorf("glob %s: %w", pattern, err)
+		}
+
+		for _, match := range matches {
+			if err := addFiles(fsys, dir, match, files); err != nil {
+				return nil, fmt.Errorf("add %s: %w", match, err)
+			}
+		}
+	}
+
+	if options.Untracked {
+		untracked, err := untrackedFiles(ctx, dir)
+		if err != nil {
+			return nil, fmt.Errorf("untracked files: %w", err)
+		}
+
+		for _, file := range untracked {
+			files[file] = struct{}{}
+		}
+	}
+
+	excludes := make([]string, 0, len(options.Exclude))
+
+	for _, pattern := range options.Exclude {
+		pattern, err := relativePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		excludes = append(excludes, pattern)
+	}
+
+	result := make([]string, 0, len(files))
+
+	for file := range files {
+		if !isExcluded(file, excludes) {
+			result = append(result, file)
+		}
+	}
+
+	sort.Strings(result)
+
+	return result, nil
+}
+
+// relativePattern normalizes the pattern, patterns outside of the directory are not allowed.
+func relativePattern(pattern string) (string, error) {
+	cleaned := path.Clean(filepath.ToSlash(pattern))
+
+	if path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("path %s is outside of the project directory", pattern)
+	}
+
+	return cleaned, nil
+}
+
+// addFiles adds the file or all files of the directory, the symlinked directories are not descended into.
+func addFiles(fsys fs.FS, dir, name string, files map[string]struct{}) error {
+	symlinked, err := hasSymlinkedParent(dir, name)
+	if err != nil || symlinked {
+		return err
+	}
+
+	info, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(name)))
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		files[name] = struct{}{}
+		return nil
+	}
+
+	// the entries of the walked directories are not followed, so the nested symlinks are added as files.
+	return fs.WalkDir(fsys, name, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() {
+			files[path] = struct{}{}
+		}
+
+		return nil
+	})
+}
+
+// hasSymlinkedParent reports whether any parent directory of the file inside the directory is a symlink.
+func hasSymlinkedParent(dir, name string) (bool, error) {
+	for parent := path.Dir(name); parent != "."; parent = path.Dir(parent) {
+		info, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(parent)))
+		if err != nil {
+			return false, err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// isExcluded reports whether the file or one of its parent directories matches any of the patterns.
+func isExcluded(file string, patterns []string) bool {
+	for _, pattern := range patterns {
+		for name := file; name != "." && name != "/"; name = path.Dir(name) {
+			if ok, _ := doublestar.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// untrackedFiles returns files of the git repository which are not tracked, ignored files included.
+func untrackedFiles(ctx context.Context, dir string) ([]string, error) {
+	cmd := exec.CommandContext(ctx, "git", "ls-files", "-z", "--others")
+	cmd.Dir = dir
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git ls-files: %w(%s)", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var files []string
+
+	for _, file := range strings.Split(string(out), "\x00") {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+
+	return files, nil
+}
@@ -0,0 +1,131 @@
+package artifacts
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeFiles creates the files with their parent directories.
+func writeFiles(t *testing.T, dir string, files ...string) {
+	t.Helper()
+
+	for _, file := range files {
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		assert.NoError(t, os.WriteFile(path, []byte(file), 0o644))
+	}
+}
+
+func TestCollect(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(
+		t,
+		dir,
+		"build/app",
+		"build/lib/app.so",
+		"build/tmp/cache",
+		"reports/unit.xml",
+		"reports/nested/e2e.xml",
+		"reports/summary.txt",
+		"README.md",
+	)
+
+	tests := []struct {
+		name    string
+		options Options
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "directory",
+			options: Options{Paths: []string{"build/"}},
+			want:    []string{"build/app", "build/lib/app.so", "build/tmp/cache"},
+		},
+		{
+			name:    "doublestar",
+			options: Options{Paths: []string{"reports/**/*.xml"}},
+			want:    []string{"reports/nested/e2e.xml", "reports/unit.xml"},
+		},
+		{
+			name:    "exclude",
+			options: Options{Paths: []string{"./build", "README.md"}, Exclude: []string{"build/tmp", "**/*.so"}},
+			want:    []string{"README.md", "build/app"},
+		},
+		{
+			name:    "no matches",
+			options: Options{Paths: []string{"dist/*"}},
+			want:    []string{},
+		},
+		{
+			name:    "outside of the directory",
+			options: Options{Paths: []string{"../secrets"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Collect(context.Background(), dir, tt.options)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestCollect_symlinks(t *testing.T) {
+	outside := t.TempDir()
+	writeFiles(t, outside, "secret")
+
+	dir := t.TempDir()
+	writeFiles(t, dir, "build/app")
+	assert.NoError(t, os.Symlink(outside, filepath.Join(dir, "link")))
+	assert.NoError(t, os.Symlink(outside, filepath.Join(dir, "build", "link")))
+
+	// the symlinks are collected, the files behind them are not.
+	for _, paths := range [][]string{{"link"}, {"link/"}, {"link/secret"}, {"**/secret"}, {"**"}} {
+		got, err := Collect(context.Background(), dir, Options{Paths: paths})
+		assert.NoError(t, err, paths)
+		assert.NotContains(t, got, "link/secret", paths)
+		assert.NotContains(t, got, "build/link/secret", paths)
+	}
+
+	got, err := Collect(context.Background(), dir, Options{Paths: []string{"link", "build"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"build/app", "build/link", "link"}, got)
+}
+
+func TestCollect_untracked(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	dir := t.TempDir()
+	writeFiles(t, dir, "main.go", ".gitignore", "bin/app", "coverage.out")
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, ".gitignore"), []byte("bin/\n"), 0o644))
+
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "main.go", ".gitignore"},
+		{"-c", "user.name=runner", "-c", "user.email=runner@example.com", "commit", "-q", "-m", "initial"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+
+		out, err := cmd.CombinedOutput()
+		assert.NoError(t, err, string(out))
+	}
+
+	got, err := Collect(context.Background(), dir, Options{Untracked: true, Exclude: []string{"*.out"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bin/app"}, got)
+}
@@ -0,0 +1,162 @@
+package artifacts
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Extract extracts the zip archive into the directory keeping modes, modification times and symlinks.
+// Entries which would be placed outside of the directory or under a symlinked directory are rejected.
+func Extract(r io.ReaderAt, size int64, dir string) error {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return fmt.Errorf("open zip: %w", err)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("make dir: %w", err)
+	}
+
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return fmt.Errorf("resolve dir: %w", err)
+	}
+
+	for _, file := range archive.File {
+		if err := extractFile(root, file); err != nil {
+			return fmt.Errorf("extract %s: %w", file.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// extractFile extracts a single entry of the archive.
+func extractFile(root string, file *zip.File) error {
+	path := filepath.Join(root, filepath.FromSlash(file.Name))
+
+	rel, err := filepath.Rel(root, path)
+	if err != nil || !isInside(root, path) {
+		return fmt.Errorf("path is outside of the directory")
+	}
+
+	mode := file.Mode()
+
+	if mode.IsDir() {
+		return makeDirs(root, rel)
+	}
+
+	// parent directories may be symlinks extracted earlier.
+	if err := makeDirs(root, filepath.Dir(rel)); err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove existing: %w", err)
+	}
+
+	r, err := file.Open()
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	defer r.Close()
+
+	if mode&os.ModeSymlink != 0 {
+		target, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("read link: %w", err)
+		}
+
+		return os.Symlink(string(target), path)
+	}
+
+	if !mode.IsRegular() {
+		return nil
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("write: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+
+	return os.Chtimes(path, file.Modified, file.Modified)
+}
+
+// makeDirs creates the directories of the path relative to the root one by one,
+// the existing ones must not be symlinks, so nothing is created outside of the root.
+func makeDirs(root, rel string) error {
+	path := root
+
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		if name == "" || name == "." {
+			continue
+		}
+
+		path = filepath.Join(path, name)
+
+		info, err := os.Lstat(path)
+
+		switch {
+		case os.IsNotExist(err):
+			if err := os.Mkdir(path, 0o755); err != nil && !os.IsExist(err) {
+				return fmt.Errorf("make dir: %w", err)
+			}
+		case err != nil:
+			return fmt.Errorf("stat dir: %w", err)
+		case info.Mode()&os.ModeSymlink != 0:
+			return fmt.Errorf("path goes through the symlink %s", name)
+		case !info.IsDir():
+			return fmt.Errorf("%s is not a directory", name)
+		}
+	}
+
+	return nil
+}
+
+// securePath returns path of the archive entry in the root directory,
+// the entry and its resolved parent directory must be inside the root.
+func securePath(root, name string) (string, error) {
+	path := filepath.Join(root, filepath.FromSlash(name))
+
+	if !isInside(root, path) {
+		return "", fmt.Errorf("path is outside of the directory")
+	}
+
+	parent, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return path, nil
+		}
+
+		return "", fmt.Errorf("resolve parent: %w", err)
+	}
+
+	if !isInside(root, parent) {
+		return "", fmt.Errorf("path is outside of the directory")
+	}
+
+	return path, nil
+}
+
+// isInside reports whether the path is the root or is inside of it.
+func isInside(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
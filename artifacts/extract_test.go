@@ -0,0 +1,123 @@
+package artifacts
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// zipArchive creates zip archive with the entries.
+func zipArchive(t *testing.T, entries ...*zip.FileHeader) *bytes.Reader {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	archive := zip.NewWriter(&buf)
+
+	for _, entry := range entries {
+		w, err := archive.CreateHeader(entry)
+		assert.NoError(t, err)
+
+		_, err = w.Write([]byte(entry.Comment))
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, archive.Close())
+
+	return bytes.NewReader(buf.Bytes())
+}
+
+// zipEntry returns archive entry with the content stored in the comment.
+func zipEntry(name string, mode os.FileMode, content string) *zip.FileHeader {
+	header := &zip.FileHeader{Name: name, Comment: content}
+	header.SetMode(mode)
+
+	return header
+}
+
+func TestExtract(t *testing.T) {
+	src := t.TempDir()
+	writeFiles(t, src, "bin/app", "README.md")
+	assert.NoError(t, os.Chmod(filepath.Join(src, "bin", "app"), 0o755))
+	assert.NoError(t, os.Symlink("bin/app", filepath.Join(src, "app")))
+
+	var buf bytes.Buffer
+	assert.NoError(t, Archive(&buf, src, []string{"README.md", "app", "bin/app"}, FormatZip))
+
+	dst := t.TempDir()
+	writeFiles(t, dst, "README.md")
+
+	assert.NoError(t, Extract(bytes.NewReader(buf.Bytes()), int64(buf.Len()), dst))
+
+	content, err := os.ReadFile(filepath.Join(dst, "bin", "app"))
+	assert.NoError(t, err)
+	assert.Equal(t, "bin/app", string(content))
+
+	info, err := os.Stat(filepath.Join(dst, "bin", "app"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o755), info.Mode().Perm())
+
+	target, err := os.Readlink(filepath.Join(dst, "app"))
+	assert.NoError(t, err)
+	assert.Equal(t, "bin/app", target)
+}
+
+func TestExtract_outside(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []*zip.FileHeader
+	}{
+		{
+			name:    "parent directory",
+			entries: []*zip.FileHeader{zipEntry("../evil", 0o644, "evil")},
+		},
+		{
+			name:    "nested parent directory",
+			entries: []*zip.FileHeader{zipEntry("bin/../../evil", 0o644, "evil")},
+		},
+		{
+			name: "symlink",
+			entries: []*zip.FileHeader{
+				zipEntry("escape", os.ModeSymlink|0o777, ".."),
+				zipEntry("escape/evil", 0o644, "evil"),
+			},
+		},
+		{
+			name: "nested directory behind symlink",
+			entries: []*zip.FileHeader{
+				zipEntry("escape", os.ModeSymlink|0o777, ".."),
+				zipEntry("escape/nested/evil/", os.ModeDir|0o755, ""),
+			},
+		},
+		{
+			name: "nested file behind symlink",
+			entries: []*zip.FileHeader{
+				zipEntry("escape", os.ModeSymlink|0o777, ".."),
+				zipEntry("escape/nested/evil", 0o644, "evil"),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := t.TempDir()
+			dir := filepath.Join(parent, "project")
+
+			r := zipArchive(t, tt.entries...)
+
+			assert.Error(t, Extract(r, r.Size(), dir))
+
+			// nothing is created next to the directory.
+			entries, err := os.ReadDir(parent)
+			assert.NoError(t, err)
+
+			if assert.Len(t, entries, 1) {
+				assert.Equal(t, "project", entries[0].Name())
+			}
+		})
+	}
+}
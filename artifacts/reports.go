@@ -0,0 +1,89 @@
+package artifacts
+
+import (
+	"bufio"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+const (
+	// MaxDotenvSize maximum size of the dotenv report in bytes.
+	MaxDotenvSize = 5 * 1024
+	// MaxDotenvVariables maximum number of the variables in the dotenv report.
+	MaxDotenvVariables = 20
+)
+
+// dotenvKey valid name of the dotenv variable.
+var dotenvKey = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// ValidateJUnit checks that the report is a well-formed XML document with testsuites or testsuite root element.
+func ValidateJUnit(r io.Reader) error {
+	decoder := xml.NewDecoder(r)
+	root := ""
+
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("invalid XML: %w", err)
+		}
+
+		if start, ok := token.(xml.StartElement); ok && root == "" {
+			root = start.Name.Local
+		}
+	}
+
+	if root != "testsuites" && root != "testsuite" {
+		return fmt.Errorf("unexpected root element %q", root)
+	}
+
+	return nil
+}
+
+// ParseDotenv parses the dotenv report in KEY=VALUE form and validates its limits,
+// empty lines and comments are ignored.
+func ParseDotenv(r io.Reader) ([]string, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxDotenvSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("read: %w", err)
+	}
+
+	if len(data) > MaxDotenvSize {
+		return nil, fmt.Errorf("report is larger than %d bytes", MaxDotenvSize)
+	}
+
+	var variables []string
+
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(text, "=", 2)
+		if len(parts) != 2 || !dotenvKey.MatchString(parts[0]) {
+			return nil, fmt.Errorf("line %d: invalid variable", line)
+		}
+
+		variables = append(variables, parts[0]+"="+parts[1])
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scan: %w", err)
+	}
+
+	if len(variables) > MaxDotenvVariables {
+		return nil, fmt.Errorf("report has more than %d variables", MaxDotenvVariables)
+	}
+
+	return variables, nil
+}
@@ -0,0 +1,68 @@
+package artifacts
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateJUnit(t *testing.T) {
+	tests := []struct {
+		name    string
+		report  string
+		wantErr bool
+	}{
+		{
+			name:   "testsuites",
+			report: `<?xml version="1.0"?><testsuites><testsuite name="unit"><testcase name="a"/></testsuite></testsuites>`,
+		},
+		{
+			name:   "testsuite",
+			report: `<testsuite name="unit"><testcase name="a"/></testsuite>`,
+		},
+		{
+			name:    "malformed",
+			report:  `<testsuites><testsuite>`,
+			wantErr: true,
+		},
+		{
+			name:    "not junit",
+			report:  `<coverage line-rate="0.5"/>`,
+			wantErr: true,
+		},
+		{
+			name:    "empty",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateJUnit(strings.NewReader(tt.report))
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestParseDotenv(t *testing.T) {
+	variables, err := ParseDotenv(strings.NewReader("# build info\nVERSION=1.2.3\n\nDYNAMIC_URL=https://example.com/?a=b\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"VERSION=1.2.3", "DYNAMIC_URL=https://example.com/?a=b"}, variables)
+
+	_, err = ParseDotenv(strings.NewReader("1VERSION=1.2.3\n"))
+	assert.Error(t, err)
+
+	_, err = ParseDotenv(strings.NewReader("VERSION\n"))
+	assert.Error(t, err)
+
+	_, err = ParseDotenv(strings.NewReader(strings.Repeat("KEY=VALUE\n", MaxDotenvVariables+1)))
+	assert.Error(t, err)
+
+	_, err = ParseDotenv(strings.NewReader("KEY=" + strings.Repeat("v", MaxDotenvSize)))
+	assert.Error(t, err)
+}
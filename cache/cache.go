@@ -0,0 +1,127 @@
+// Package cache stores job caches in the local directory or in the S3-compatible storage.
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ihippik/gitlab-runner/artifacts"
+)
+
+// policies of the job cache.
+const (
+	// PolicyPull the cache is only restored before the job.
+	PolicyPull = "pull"
+	// PolicyPush the cache is only saved after the job.
+	PolicyPush = "push"
+	// PolicyPullPush the cache is restored before and saved after the job.
+	PolicyPullPush = "pull-push"
+)
+
+// ErrNotFound returned when the cache archive does not exist.
+var ErrNotFound = errors.New("cache not found")
+
+// Backend storage of the cache archives.
+type Backend interface {
+	// Get writes the archive stored under the name, ErrNotFound is returned if it does not exist.
+	Get(ctx context.Context, name string, w io.Writer) error
+	// Put stores the archive of the specified size under the name.
+	Put(ctx context.Context, name string, r io.Reader, size int64) error
+}
+
+// Restore extracts the first existing archive of the names into the directory
+// and returns its name. The archive is downloaded into the temporary directory.
+func Restore(ctx context.Context, backend Backend, dir, tmpDir string, names []string) (string, error) {
+	for _, name := range names {
+		err := restore(ctx, backend, dir, tmpDir, name)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+
+		if err != nil {
+			return "", fmt.Errorf("restore %s: %w", name, err)
+		}
+
+		return name, nil
+	}
+
+	return "", ErrNotFound
+}
+
+// restore downloads the archive and extracts it into the directory.
+func restore(ctx context.Context, backend Backend, dir, tmpDir, name string) error {
+	file, err := os.CreateTemp(tmpDir, "cache-*.zip")
+	if err != nil {
+		return fmt.Errorf("create archive: %w", err)
+	}
+
+	defer func() {
+		file.Close()
+		os.Remove(file.Name())
+	}()
+
+	if err := backend.Get(ctx, name, file); err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("stat archive: %w", err)
+	}
+
+	if err := artifacts.Extract(file, info.Size(), dir); err != nil {
+		return fmt.Errorf("extract: %w", err)
+	}
+
+	return nil
+}
+
+// Save archives the files of the directory which match the options and stores the archive under the name,
+// returns the number of archived files. Nothing is stored if there are no files.
+func Save(
+	ctx context.Context,
+	backend Backend,
+	dir, tmpDir, name string,
+	options artifacts.Options,
+) (int, error) {
+	files, err := artifacts.Collect(ctx, dir, options)
+	if err != nil {
+		return 0, fmt.Errorf("collect: %w", err)
+	}
+
+	if len(files) == 0 {
+		return 0, nil
+	}
+
+	file, err := os.CreateTemp(tmpDir, "cache-*.zip")
+	if err != nil {
+		return 0, fmt.Errorf("create archive: %w", err)
+	}
+
+	defer func() {
+		file.Close()
+		os.Remove(file.Name())
+	}()
+
+	if err := artifacts.Archive(file, dir, files, artifacts.FormatZip); err != nil {
+		return 0, fmt.Errorf("archive: %w", err)
+	}
+
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, fmt.Errorf("archive size: %w", err)
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("rewind archive: %w", err)
+	}
+
+	if err := backend.Put(ctx, name, file, size); err != nil {
+		return 0, fmt.Errorf("put %s: %w", name, err)
+	}
+
+	return len(files), nil
+}
@@ -0,0 +1,58 @@
+package cache
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ihippik/gitlab-runner/artifacts"
+)
+
+func TestSaveRestore(t *testing.T) {
+	backend := NewLocalBackend(t.TempDir())
+
+	src := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(src, "node_modules", "left-pad"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(src, "node_modules", "left-pad", "index.js"), []byte("pad"), 0o644))
+
+	// nothing is stored without files.
+	n, err := Save(context.Background(), backend, src, t.TempDir(), "project/1/empty/cache.zip", artifacts.Options{
+		Paths: []string{"vendor/"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	n, err = Save(context.Background(), backend, src, t.TempDir(), "project/1/main/cache.zip", artifacts.Options{
+		Paths: []string{"node_modules/"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// the first existing key wins.
+	dst := t.TempDir()
+
+	restored, err := Restore(context.Background(), backend, dst, t.TempDir(), []string{
+		"project/1/feature/cache.zip",
+		"project/1/empty/cache.zip",
+		"project/1/main/cache.zip",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "project/1/main/cache.zip", restored)
+
+	content, err := os.ReadFile(filepath.Join(dst, "node_modules", "left-pad", "index.js"))
+	assert.NoError(t, err)
+	assert.Equal(t, "pad", string(content))
+
+	_, err = Restore(context.Background(), backend, dst, t.TempDir(), []string{"project/1/feature/cache.zip"})
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestLocalBackend_path(t *testing.T) {
+	backend := NewLocalBackend("/cache")
+
+	assert.Equal(t, "/cache/project/1/main/cache.zip", backend.path("project/1/main/cache.zip"))
+	assert.Equal(t, "/cache/etc/passwd", backend.path("../../etc/passwd"))
+}
@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// LocalBackend stores cache archives in the local directory.
+type LocalBackend struct {
+	dir string
+}
+
+// NewLocalBackend create new backend which stores archives in the directory.
+func NewLocalBackend(dir string) *LocalBackend {
+	return &LocalBackend{dir: dir}
+}
+
+// Get implements Backend interface.
+func (l *LocalBackend) Get(_ context.Context, name string, w io.Writer) error {
+	file, err := os.Open(l.path(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
+
+		return fmt.Errorf("open: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(w, file); err != nil {
+		return fmt.Errorf("copy: %w", err)
+	}
+
+	return nil
+}
+
+// Put implements Backend interface.
+// The archive is written into the temporary file first, so concurrent jobs never see a partial archive.
+func (l *LocalBackend) Put(_ context.Context, name string, r io.Reader, _ int64) error {
+	archivePath := l.path(name)
+
+	if err := os.MkdirAll(filepath.Dir(archivePath), 0o755); err != nil {
+		return fmt.Errorf("make dir: %w", err)
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(archivePath), ".cache-*")
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		return fmt.Errorf("copy: %w", err)
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+
+	if err := os.Rename(file.Name(), archivePath); err != nil {
+		return fmt.Errorf("rename: %w", err)
+	}
+
+	return nil
+}
+
+// path returns path of the archive file.
+func (l *LocalBackend) path(name string) string {
+	return filepath.Join(l.dir, filepath.FromSlash(path.Clean("/"+name)))
+}
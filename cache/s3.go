@@ -0,0 +1,252 @@
+package cache
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ihippik/gitlab-runner/config"
+)
+
+const (
+	// defaultBucketLocation region used when the bucket location is not configured.
+	defaultBucketLocation = "us-east-1"
+	// unsignedPayload payload hash of the requests which body is not signed.
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	// amzDateFormat format of the request time used in the signature.
+	amzDateFormat = "20060102T150405Z"
+)
+
+// S3Backend stores cache archives in the bucket of the S3-compatible storage.
+// Requests are signed with AWS Signature Version 4 and use path-style URLs.
+type S3Backend struct {
+	cfg    config.CacheS3Cfg
+	client *http.Client
+	now    func() time.Time
+}
+
+// NewS3Backend create new S3-compatible backend.
+func NewS3Backend(cfg config.CacheS3Cfg, client *http.Client) (*S3Backend, error) {
+	if cfg.ServerAddress == "" || cfg.BucketName == "" {
+		return nil, errors.New("server address and bucket name are required")
+	}
+
+	if cfg.BucketLocation == "" {
+		cfg.BucketLocation = defaultBucketLocation
+	}
+
+	return &S3Backend{cfg: cfg, client: client, now: time.Now}, nil
+}
+
+// Get implements Backend interface.
+func (s *S3Backend) Get(ctx context.Context, name string, w io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(name), nil)
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return ErrNotFound
+	default:
+		return fmt.Errorf("bad status: %s", resp.Status)
+	}
+
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("read body: %w", err)
+	}
+
+	return nil
+}
+
+// Put implements Backend interface.
+func (s *S3Backend) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(name), r)
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/zip")
+
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("bad status: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// do signs and sends the request.
+func (s *S3Backend) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	signV4(req, s.cfg.AccessKey, s.cfg.SecretKey, s.cfg.BucketLocation, s.now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do request: %w", err)
+	}
+
+	return resp, nil
+}
+
+// objectURL returns path-style URL of the object.
+func (s *S3Backend) objectURL(name string) string {
+	scheme := "https"
+	if s.cfg.Insecure {
+		scheme = "http"
+	}
+
+	return fmt.Sprintf(
+		"%s://%s/%s/%s",
+		scheme,
+		s.cfg.ServerAddress,
+		uriEncode(s.cfg.BucketName, false),
+		uriEncode(strings.TrimPrefix(name, "/"), true),
+	)
+}
+
+// signV4 signs the request with AWS Signature Version 4 for the S3 service.
+// The payload hash must be set in the X-Amz-Content-Sha256 header.
+func signV4(req *http.Request, accessKey, secretKey, region string, now time.Time) {
+	amzDate := now.UTC().Format(amzDateFormat)
+	date := amzDate[:8]
+	scope := date + "/" + region + "/s3/aws4_request"
+
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+
+	for key, values := range req.Header {
+		key = strings.ToLower(key)
+
+		if strings.HasPrefix(key, "x-amz-") || key == "content-type" || key == "content-md5" || key == "range" {
+			headers[key] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	var canonicalHeaders strings.Builder
+	for _, key := range keys {
+		canonicalHeaders.WriteString(key + ":" + headers[key] + "\n")
+	}
+
+	signedHeaders := strings.Join(keys, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, true),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hexSHA256([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey,
+		scope,
+		signedHeaders,
+		hex.EncodeToString(hmacSHA256(key, stringToSign)),
+	))
+}
+
+// canonicalQuery returns query string sorted by keys with encoded keys and values.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	var params []string
+
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+
+		for _, value := range values {
+			params = append(params, uriEncode(key, false)+"="+uriEncode(value, false))
+		}
+	}
+
+	return strings.Join(params, "&")
+}
+
+// uriEncode encodes all characters except the unreserved ones as required by the signature,
+// the slashes are kept if keepSlash is set.
+func uriEncode(s string, keepSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&0x0f])
+		}
+	}
+
+	return b.String()
+}
+
+// hmacSHA256 returns HMAC-SHA256 of the data.
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+
+	return h.Sum(nil)
+}
+
+// hexSHA256 returns hex encoded SHA256 of the data.
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -44,14 +44,53 @@ func initConfig(path string) (*config.Config, error) {
 	return &cfg, nil
 }
 
-func executorFactory(logger *logrus.Entry, kind string) runner.Executor {
-	const executorKindShell = "shell"
+// executorFactory returns a factory of executors of the kind specified in the runner config,
+// the config file is hidden from the jobs by the executors isolating them on the host.
+func executorFactory(logger *logrus.Entry, cfg *config.RunnerCfg, configFile string) runner.ExecutorFactory {
+	const (
+		executorKindShell   = "shell"
+		executorKindDocker  = "docker"
+		executorKindCustom  = "custom"
+		executorKindSSH     = "ssh"
+		executorKindSandbox = "sandbox"
+	)
 
-	switch kind {
+	switch cfg.Executor {
 	case executorKindShell:
-		return executor.NewShellExecutor()
+		return func() runner.Executor {
+			return executor.NewShellExecutor()
+		}
+	case executorKindDocker:
+		client, err := executor.NewDockerClient(cfg.Docker.Host)
+		if err != nil {
+			logger.WithError(err).Fatalln("docker client")
+		}
+
+		return func() runner.Executor {
+			return executor.NewDockerExecutor(client, cfg.Docker)
+		}
+	case executorKindCustom:
+		if cfg.Custom.RunExec == "" {
+			logger.Fatalln("custom executor: run_exec is not configured")
+		}
+
+		return func() runner.Executor {
+			return executor.NewCustomExecutor(cfg.Custom)
+		}
+	case executorKindSSH:
+		if cfg.SSH.Host == "" {
+			logger.Fatalln("ssh executor: host is not configured")
+		}
+
+		return func() runner.Executor {
+			return executor.NewSSHExecutor(cfg.SSH)
+		}
+	case executorKindSandbox:
+		return func() runner.Executor {
+			return executor.NewSandboxExecutor(cfg.Sandbox, configFile)
+		}
 	default:
-		logger.WithField("executor_kind", kind).Fatalln("not support yet")
+		logger.WithField("executor_kind", cfg.Executor).Fatalln("not support yet")
 		return nil
 	}
 }
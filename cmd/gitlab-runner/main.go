@@ -9,6 +9,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 
+	"github.com/ihippik/gitlab-runner/executor"
 	"github.com/ihippik/gitlab-runner/runner"
 )
 
@@ -18,6 +19,9 @@ var GITVersion = "local"
 const gitlabAPI = "api/v4"
 
 func main() {
+	// the sandbox executor re-executes the runner as the init process of the sandbox.
+	executor.InitSandbox()
+
 	var (
 		srv    *runner.Service
 		logger *logrus.Entry
@@ -42,7 +46,7 @@ func main() {
 
 			logger = initLogger(cfg.Logger, GITVersion, cfg.Runner.Executor)
 			api := runner.NewGitlabAPI(http.DefaultClient, cfg.Runner.URL+gitlabAPI)
-			srv = runner.NewService(logger, cfg, api, executorFactory(logger, cfg.Runner.Executor))
+			srv = runner.NewService(logger, cfg, api, executorFactory(logger, cfg.Runner, c.String("c")))
 
 			return nil
 		},
@@ -6,8 +6,10 @@ import "time"
 type (
 	// Config represent service config.
 	Config struct {
-		Runner *RunnerCfg
-		Logger *LoggerCfg
+		// Concurrent limits how many jobs can run concurrently across all runners (default 1).
+		Concurrent int
+		Runner     *RunnerCfg
+		Logger     *LoggerCfg
 	}
 
 	// RunnerCfg gitlab-runner config section.
@@ -18,6 +20,143 @@ type (
 		Executor string
 		Tags     []string
 		Interval time.Duration
+		// Limit limits how many jobs can be handled concurrently by this runner (0 means no limit).
+		Limit int
+		// MaximumTimeout caps the job timeout received from the Gitlab (0 means no cap).
+		MaximumTimeout time.Duration `yaml:"maximum_timeout"`
+		// TraceFlushInterval interval between sending of the job trace chunks to the Gitlab.
+		TraceFlushInterval time.Duration `yaml:"trace_flush_interval"`
+		// TraceFlushSize size of the buffered job trace (in bytes) after which it is sent immediately.
+		TraceFlushSize int `yaml:"trace_flush_size"`
+		// MaskEncoded masks URL-encoded and base64 forms of the masked variables too.
+		MaskEncoded bool `yaml:"mask_encoded"`
+		// BuildsDir directory in which the builds are stored (default "builds" in the working directory).
+		BuildsDir string `yaml:"builds_dir"`
+		// CacheDir directory in which the job caches are stored (default "cache" in the working directory).
+		CacheDir string `yaml:"cache_dir"`
+		// Cleanup policy of the build directories.
+		Cleanup CleanupCfg
+		// Cache storage of the job caches.
+		Cache CacheCfg
+		// Docker settings of the docker executor.
+		Docker DockerCfg
+		// Custom settings of the custom executor.
+		Custom CustomCfg
+		// SSH settings of the ssh executor.
+		SSH SSHCfg `yaml:"ssh"`
+		// Sandbox settings of the sandbox executor.
+		Sandbox SandboxCfg
+	}
+
+	// SandboxCfg sandbox executor config section.
+	SandboxCfg struct {
+		// ReadOnlyRoot mounts the whole filesystem read-only, only the build directories stay writable.
+		// By default (false) the jobs may write everything the runner user can, except the other builds,
+		// the local caches and the runner config which are always hidden from them. Every job has its own /tmp.
+		ReadOnlyRoot bool `yaml:"read_only_root"`
+		// Network gives the job scripts access to the host network, otherwise only the sources are fetched
+		// with the network and the job scripts run with the loopback interface only.
+		Network bool
+	}
+
+	// SSHCfg ssh executor config section. The scripts run on another machine, so the jobs
+	// with file variables, artifacts or dependencies fail and the caches are skipped.
+	SSHCfg struct {
+		// Host address of the build machine.
+		Host string
+		// Port of the SSH server (default 22).
+		Port int
+		// User on the build machine.
+		User string
+		// Password of the user, used when the identity file is not specified.
+		Password string
+		// IdentityFile path of the unencrypted private key of the user.
+		IdentityFile string `yaml:"identity_file"`
+		// KnownHostsFile file with the public keys of the build machines (default "~/.ssh/known_hosts").
+		KnownHostsFile string `yaml:"known_hosts_file"`
+		// CleanupTimeout limits removal of the directories on the build machine after the job (default 1m).
+		CleanupTimeout time.Duration `yaml:"cleanup_timeout"`
+	}
+
+	// CustomCfg custom executor config section, the executables are called in the order:
+	// config, prepare, run for the prepare_script stage creating the build directory and for every stage of the job,
+	// cleanup. The scripts may run on another machine,
+	// so the jobs with file variables, artifacts or dependencies fail and the caches are skipped.
+	CustomCfg struct {
+		// ConfigExec executable which prints the executor configuration in JSON to the stdout.
+		ConfigExec string `yaml:"config_exec"`
+		// ConfigArgs arguments of the ConfigExec.
+		ConfigArgs []string `yaml:"config_args"`
+		// ConfigExecTimeout limits execution of the ConfigExec (default 1h).
+		ConfigExecTimeout time.Duration `yaml:"config_exec_timeout"`
+		// PrepareExec executable which prepares the job environment, e.g. provisions a VM.
+		PrepareExec string `yaml:"prepare_exec"`
+		// PrepareArgs arguments of the PrepareExec.
+		PrepareArgs []string `yaml:"prepare_args"`
+		// PrepareExecTimeout limits execution of the PrepareExec (default 1h).
+		PrepareExecTimeout time.Duration `yaml:"prepare_exec_timeout"`
+		// RunExec executable which runs the script, the path of the script and the stage name are appended to RunArgs.
+		RunExec string `yaml:"run_exec"`
+		// RunArgs arguments of the RunExec.
+		RunArgs []string `yaml:"run_args"`
+		// CleanupExec executable which cleans up the job environment.
+		CleanupExec string `yaml:"cleanup_exec"`
+		// CleanupArgs arguments of the CleanupExec.
+		CleanupArgs []string `yaml:"cleanup_args"`
+		// CleanupExecTimeout limits execution of the CleanupExec (default 1h).
+		CleanupExecTimeout time.Duration `yaml:"cleanup_exec_timeout"`
+	}
+
+	// DockerCfg docker executor config section.
+	DockerCfg struct {
+		// Host address of the Docker Engine API, only unix sockets are supported
+		// (default "unix:///var/run/docker.sock").
+		Host string
+		// Image used by the jobs which do not specify the image.
+		Image string
+		// HelperImage image with git which fetches the sources (default "alpine/git:latest").
+		HelperImage string `yaml:"helper_image"`
+		// PullPolicy one of "if-not-present" (default), "always" or "never".
+		PullPolicy string `yaml:"pull_policy"`
+		// ServicesWaitTimeout how long to wait for the exposed ports of the services (default 30s).
+		ServicesWaitTimeout time.Duration `yaml:"services_wait_timeout"`
+		// CleanupTimeout limits removal of the containers and the network after the job (default 1m).
+		CleanupTimeout time.Duration `yaml:"cleanup_timeout"`
+	}
+
+	// CacheCfg job cache config section.
+	CacheCfg struct {
+		// Type of the storage, "local" (default) stores caches in the CacheDir, "s3" in the S3-compatible storage.
+		Type string
+		// S3 connection settings of the S3-compatible storage.
+		S3 CacheS3Cfg `yaml:"s3"`
+	}
+
+	// CacheS3Cfg S3-compatible cache storage config section.
+	CacheS3Cfg struct {
+		// ServerAddress host and optional port of the storage server.
+		ServerAddress string `yaml:"server_address"`
+		// AccessKey access key of the storage.
+		AccessKey string `yaml:"access_key"`
+		// SecretKey secret key of the storage.
+		SecretKey string `yaml:"secret_key"`
+		// BucketName bucket in which the caches are stored.
+		BucketName string `yaml:"bucket_name"`
+		// BucketLocation region of the bucket (default "us-east-1").
+		BucketLocation string `yaml:"bucket_location"`
+		// Insecure uses plain HTTP instead of HTTPS.
+		Insecure bool
+	}
+
+	// CleanupCfg build directories cleanup config section.
+	CleanupCfg struct {
+		// Policy one of "never" (default), "always", "on_success" or "keep_last".
+		Policy string
+		// KeepLast number of the most recently used build directories kept by "keep_last" policy.
+		KeepLast int `yaml:"keep_last"`
+		// MaxDiskUsage maximum size of the builds directory in bytes, the least recently used
+		// build directories are removed when it is exceeded (0 means no limit).
+		MaxDiskUsage int64 `yaml:"max_disk_usage"`
 	}
 
 	// LoggerCfg logger config section.
@@ -0,0 +1,232 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ihippik/gitlab-runner/config"
+)
+
+const (
+	// defaultCustomExecTimeout limits execution of the config, prepare and cleanup executables when it is not configured.
+	defaultCustomExecTimeout = time.Hour
+	// customBuildFailureExitCode exit code of the executables which means the failure of the job script.
+	customBuildFailureExitCode = 1
+	// customSystemFailureExitCode exit code of the executables which means the failure of the environment.
+	customSystemFailureExitCode = 2
+	// customEnvPrefix prefix of the job variables passed to the executables.
+	customEnvPrefix = "CUSTOM_ENV_"
+	// defaultCustomStage stage name passed to the run executable when the stage of the script is unknown.
+	defaultCustomStage = "step_script"
+	// customPrepareStage stage name passed to the run executable with the script which creates the build directory.
+	customPrepareStage = "prepare_script"
+)
+
+// customConfig configuration printed by the config executable.
+type customConfig struct {
+	Driver struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"driver"`
+	// JobEnv variables passed to all the executables along with the job variables.
+	JobEnv map[string]string `json:"job_env"`
+}
+
+// CustomExecutor represent executor which delegates the job environment management and the script execution
+// to the user-provided executables. The job variables are passed to them with CUSTOM_ENV_ prefix,
+// the executables must exit with $BUILD_FAILURE_EXIT_CODE if the job script has failed,
+// any other non-zero exit code, e.g. $SYSTEM_FAILURE_EXIT_CODE, is treated as the failure of the runner.
+type CustomExecutor struct {
+	cfg config.CustomCfg
+
+	homeDir string
+	env     []string
+	jobEnv  []string
+}
+
+// NewCustomExecutor create new instance of custom executor.
+func NewCustomExecutor(cfg config.CustomCfg) *CustomExecutor {
+	return &CustomExecutor{cfg: cfg}
+}
+
+// HomeDirectory set working directory of the scripts.
+func (c *CustomExecutor) HomeDirectory(dir string) {
+	c.homeDir = dir
+}
+
+// Environment set job environment in KEY=VALUE form.
+func (c *CustomExecutor) Environment(env []string) {
+	c.env = env
+}
+
+// Prepare implements interface and runs the config and prepare executables,
+// their output except the configuration is streamed into the output.
+// The build directory is created by the run executable since the scripts may be executed on another machine.
+func (c *CustomExecutor) Prepare(ctx context.Context, _ Options, output io.Writer) error {
+	if c.cfg.ConfigExec != "" {
+		if err := c.configure(ctx, output); err != nil {
+			return err
+		}
+	}
+
+	if c.cfg.PrepareExec != "" {
+		prepareCtx, cancel := context.WithTimeout(ctx, execTimeout(c.cfg.PrepareExecTimeout))
+		err := c.exec(prepareCtx, "prepare", c.cfg.PrepareExec, c.cfg.PrepareArgs, output, output)
+		cancel()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.homeDir == "" {
+		return nil
+	}
+
+	if err := c.run(WithStage(ctx, customPrepareStage), "", "mkdir -p "+Quote(c.homeDir), output); err != nil {
+		// the script of the job has not started yet, so even its exit status is the failure of the environment.
+		return fmt.Errorf("make build dir: %v", err)
+	}
+
+	return nil
+}
+
+// Execute implements interface and passes the script to the run executable along with the stage name.
+// The script exports the job variables itself since it may be executed on another machine.
+func (c *CustomExecutor) Execute(ctx context.Context, script string, output io.Writer) error {
+	return c.run(ctx, c.homeDir, script, output)
+}
+
+// run passes the script with the exported job variables to the run executable, the script is executed in the dir.
+func (c *CustomExecutor) run(ctx context.Context, dir, script string, output io.Writer) error {
+	path, err := writeScript(exportScript(c.env, dir, script))
+	if err != nil {
+		return fmt.Errorf("write script: %w", err)
+	}
+	defer os.Remove(path)
+
+	stage := Stage(ctx)
+	if stage == "" {
+		stage = defaultCustomStage
+	}
+
+	args := append(append([]string{}, c.cfg.RunArgs...), path, stage)
+
+	return c.exec(ctx, "run", c.cfg.RunExec, args, output, output)
+}
+
+// Cleanup implements interface and runs the cleanup executable within its own timeout.
+func (c *CustomExecutor) Cleanup(ctx context.Context) error {
+	if c.cfg.CleanupExec == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, execTimeout(c.cfg.CleanupExecTimeout))
+	defer cancel()
+
+	return c.exec(ctx, "cleanup", c.cfg.CleanupExec, c.cfg.CleanupArgs, ioutil.Discard, ioutil.Discard)
+}
+
+// execTimeout returns the configured timeout of the executable or the default one.
+func execTimeout(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return defaultCustomExecTimeout
+	}
+
+	return timeout
+}
+
+// configure runs the config executable and applies the configuration from its stdout.
+func (c *CustomExecutor) configure(ctx context.Context, output io.Writer) error {
+	ctx, cancel := context.WithTimeout(ctx, execTimeout(c.cfg.ConfigExecTimeout))
+	defer cancel()
+
+	var stdout bytes.Buffer
+
+	if err := c.exec(ctx, "config", c.cfg.ConfigExec, c.cfg.ConfigArgs, &stdout, output); err != nil {
+		return err
+	}
+
+	var cfg customConfig
+
+	if stdout.Len() > 0 {
+		if err := json.Unmarshal(stdout.Bytes(), &cfg); err != nil {
+			return fmt.Errorf("config: unmarshal output: %w", err)
+		}
+	}
+
+	if cfg.Driver.Name != "" {
+		fmt.Fprintf(output, "Using Custom executor with driver %s %s...\n", cfg.Driver.Name, cfg.Driver.Version)
+	}
+
+	keys := make([]string, 0, len(cfg.JobEnv))
+	for key := range cfg.JobEnv {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	c.jobEnv = c.jobEnv[:0]
+	for _, key := range keys {
+		c.jobEnv = append(c.jobEnv, key+"="+cfg.JobEnv[key])
+	}
+
+	return nil
+}
+
+// exec runs the executable of the phase until the context is done,
+// the exit codes are converted according to the conventions of the custom executor.
+func (c *CustomExecutor) exec(
+	ctx context.Context,
+	phase, path string,
+	args []string,
+	stdout, stderr io.Writer,
+) error {
+	cmd := exec.Command(path, args...)
+	cmd.Env = c.environ()
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err := runProcess(ctx, cmd)
+
+	var exitErr *ExitError
+
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &exitErr) && exitErr.Code == customBuildFailureExitCode:
+		return exitErr
+	case errors.As(err, &exitErr):
+		// any other exit code is the failure of the driver itself, so the runner reports it as its own failure.
+		return fmt.Errorf("%s: system failure, exit status %d", phase, exitErr.Code)
+	default:
+		return fmt.Errorf("%s: %w", phase, err)
+	}
+}
+
+// environ returns environment of the executables.
+func (c *CustomExecutor) environ() []string {
+	env := os.Environ()
+
+	for _, variable := range c.env {
+		env = append(env, customEnvPrefix+variable)
+	}
+
+	env = append(env, c.jobEnv...)
+
+	return append(
+		env,
+		"BUILD_FAILURE_EXIT_CODE="+strconv.Itoa(customBuildFailureExitCode),
+		"SYSTEM_FAILURE_EXIT_CODE="+strconv.Itoa(customSystemFailureExitCode),
+	)
+}
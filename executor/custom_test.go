@@ -0,0 +1,130 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ihippik/gitlab-runner/config"
+)
+
+// writeExecutable writes bash script of the custom executor into the directory.
+func writeExecutable(t *testing.T, dir, name, body string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("#!/usr/bin/env bash\n"+body), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestCustomExecutor(t *testing.T) {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "log")
+
+	cfg := config.CustomCfg{
+		ConfigExec: writeExecutable(t, dir, "config", `
+echo "configuring" >&2
+echo '{"driver":{"name":"vm","version":"v1.0"},"job_env":{"VM_ID":"vm-42"}}'
+`),
+		PrepareExec: writeExecutable(t, dir, "prepare", `echo "provisioning $VM_ID for $CUSTOM_ENV_CI_JOB_NAME"`),
+		// the script is executed in a clean environment as it would be on another machine.
+		RunExec: writeExecutable(t, dir, "run", `
+echo "$3" >> `+log+`
+env -i PATH="$PATH" bash "$2" || exit "$BUILD_FAILURE_EXIT_CODE"
+`),
+		RunArgs:     []string{"--vm"},
+		CleanupExec: writeExecutable(t, dir, "cleanup", `echo "cleanup $VM_ID" >> `+log),
+	}
+
+	// the build directory is created by the run executable.
+	homeDir := filepath.Join(dir, "builds", "project")
+
+	c := NewCustomExecutor(cfg)
+	c.Environment([]string{"CI_JOB_NAME=test", "QUOTED=it's"})
+	c.HomeDirectory(homeDir)
+
+	var out bytes.Buffer
+
+	assert.NoError(t, c.Prepare(context.Background(), Options{}, &out))
+	assert.Contains(t, out.String(), "configuring\n")
+	assert.Contains(t, out.String(), "Using Custom executor with driver vm v1.0...\n")
+	assert.Contains(t, out.String(), "provisioning vm-42 for test\n")
+	assert.NotContains(t, out.String(), "job_env")
+
+	out.Reset()
+
+	ctx := WithStage(context.Background(), "get_sources")
+	assert.NoError(t, c.Execute(ctx, "echo $CI_JOB_NAME $QUOTED; pwd", &out))
+	assert.Equal(t, "test it's\n"+homeDir+"\n", out.String())
+
+	// failure of the script is the build failure.
+	err := c.Execute(context.Background(), "exit 3", &out)
+
+	var exitErr *ExitError
+	if assert.True(t, errors.As(err, &exitErr)) {
+		assert.Equal(t, customBuildFailureExitCode, exitErr.Code)
+	}
+
+	assert.NoError(t, c.Cleanup(context.Background()))
+
+	data, err := os.ReadFile(log)
+	assert.NoError(t, err)
+	assert.Equal(t, "prepare_script\nget_sources\nstep_script\ncleanup vm-42\n", string(data))
+}
+
+func TestCustomExecutor_failures(t *testing.T) {
+	dir := t.TempDir()
+
+	// any exit code except the build failure one is the system failure.
+	c := NewCustomExecutor(config.CustomCfg{
+		RunExec: writeExecutable(t, dir, "run", `exit "$SYSTEM_FAILURE_EXIT_CODE"`),
+	})
+
+	err := c.Execute(context.Background(), "true", &bytes.Buffer{})
+	if assert.Error(t, err) {
+		var exitErr *ExitError
+		assert.False(t, errors.As(err, &exitErr))
+		assert.True(t, strings.Contains(err.Error(), "system failure"))
+	}
+
+	// the build directory which can not be created is the system failure too.
+	runExec := writeExecutable(t, dir, "run-bash", `bash "$2" || exit "$BUILD_FAILURE_EXIT_CODE"`)
+
+	c = NewCustomExecutor(config.CustomCfg{RunExec: runExec})
+	c.HomeDirectory(filepath.Join(runExec, "project"))
+
+	err = c.Prepare(context.Background(), Options{}, &bytes.Buffer{})
+	if assert.Error(t, err) {
+		var exitErr *ExitError
+		assert.False(t, errors.As(err, &exitErr))
+	}
+
+	// the phase is limited by its own timeout.
+	c = NewCustomExecutor(config.CustomCfg{
+		PrepareExec:        writeExecutable(t, dir, "prepare", "sleep 30"),
+		PrepareExecTimeout: 200 * time.Millisecond,
+	})
+
+	start := time.Now()
+
+	err = c.Prepare(context.Background(), Options{}, &bytes.Buffer{})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, time.Since(start) < 5*time.Second)
+
+	// the configuration must be JSON.
+	c = NewCustomExecutor(config.CustomCfg{
+		ConfigExec: writeExecutable(t, dir, "config", "echo not-json"),
+	})
+
+	assert.Error(t, c.Prepare(context.Background(), Options{}, &bytes.Buffer{}))
+}
@@ -0,0 +1,533 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ihippik/gitlab-runner/config"
+)
+
+const (
+	// defaultDockerHost address of the Docker Engine API used when it is not configured.
+	defaultDockerHost = "unix:///var/run/docker.sock"
+	// dockerAPIAddress base address of the requests, the host is ignored since the client dials the socket.
+	dockerAPIAddress = "http://docker"
+	// dockerRemoveTimeout limits removal of the container after the script was executed.
+	dockerRemoveTimeout = 30 * time.Second
+	// defaultDockerCleanupTimeout limits removal of the containers and the network when it is not configured.
+	defaultDockerCleanupTimeout = time.Minute
+	// dockerErrorSize limits size of the error response read from the Docker Engine API.
+	dockerErrorSize = 64 * 1024
+	// defaultServicesWaitTimeout how long to wait for the services when it is not configured.
+	defaultServicesWaitTimeout = 30 * time.Second
+	// defaultDockerHelperImage image with git which fetches the sources when it is not configured.
+	defaultDockerHelperImage = "alpine/git:latest"
+)
+
+// available image pull policies.
+const (
+	dockerPullPolicyIfNotPresent = "if-not-present"
+	dockerPullPolicyAlways       = "always"
+	dockerPullPolicyNever        = "never"
+)
+
+// dockerShell runs the script passed as the first argument by bash if the image has it, by sh otherwise.
+const dockerShell = `if command -v bash >/dev/null 2>&1; then exec bash -c "$1"; fi; exec sh -c "$1"`
+
+// errDockerNotFound returned when the image or the container is not present on the docker host.
+var errDockerNotFound = errors.New("not found")
+
+// NewDockerClient creates HTTP client which sends requests to the Docker Engine API listening on the host.
+func NewDockerClient(host string) (*http.Client, error) {
+	if host == "" {
+		host = defaultDockerHost
+	}
+
+	socket := strings.TrimPrefix(host, "unix://")
+	if socket == host || socket == "" {
+		return nil, fmt.Errorf("unsupported docker host %q, only unix sockets are supported", host)
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		},
+	}, nil
+}
+
+// DockerExecutor represent executor which runs every script in a new container of the job image,
+// the sources are fetched in a container of the helper image.
+// The volumes are mounted at the same paths, so the build directory and the files
+// created by the previous scripts are available to the next ones.
+type DockerExecutor struct {
+	client      *http.Client
+	image       string
+	helperImage string
+	pullPolicy  string
+	waitTimeout time.Duration
+
+	cleanupTimeout time.Duration
+
+	homeDir string
+	env     []string
+	options Options
+	network string
+
+	mu         sync.Mutex
+	containers map[string]struct{}
+}
+
+// NewDockerExecutor create new instance of docker executor.
+func NewDockerExecutor(client *http.Client, cfg config.DockerCfg) *DockerExecutor {
+	waitTimeout := cfg.ServicesWaitTimeout
+	if waitTimeout <= 0 {
+		waitTimeout = defaultServicesWaitTimeout
+	}
+
+	cleanupTimeout := cfg.CleanupTimeout
+	if cleanupTimeout <= 0 {
+		cleanupTimeout = defaultDockerCleanupTimeout
+	}
+
+	helperImage := cfg.HelperImage
+	if helperImage == "" {
+		helperImage = defaultDockerHelperImage
+	}
+
+	return &DockerExecutor{
+		client:      client,
+		image:       cfg.Image,
+		helperImage: helperImage,
+		pullPolicy:  cfg.PullPolicy,
+		waitTimeout: waitTimeout,
+		containers:  make(map[string]struct{}),
+
+		cleanupTimeout: cleanupTimeout,
+	}
+}
+
+// HomeDirectory set working directory of the containers.
+func (d *DockerExecutor) HomeDirectory(dir string) {
+	d.homeDir = dir
+}
+
+// Environment set job environment in KEY=VALUE form, the runner environment is not passed to the containers.
+func (d *DockerExecutor) Environment(env []string) {
+	d.env = env
+}
+
+// Prepare implements interface and makes the job image available on the docker host
+// according to the pull policy, the runner default image is used if the job has not specified one.
+// The services are started on the network of the job and the scripts are executed only after
+// they are up and running.
+func (d *DockerExecutor) Prepare(ctx context.Context, options Options, output io.Writer) error {
+	if options.Image == "" {
+		options.Image = d.image
+	}
+
+	if options.Image == "" {
+		return errors.New("no image specified by the job or the runner config")
+	}
+
+	d.options = options
+
+	if err := d.pullImage(ctx, options.Image, output); err != nil {
+		return err
+	}
+
+	return d.startServices(ctx, options.Services, output)
+}
+
+// Cleanup implements interface and removes the services, the network of the job
+// and the containers which were not removed after the scripts.
+func (d *DockerExecutor) Cleanup(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, d.cleanupTimeout)
+	defer cancel()
+
+	d.mu.Lock()
+	ids := make([]string, 0, len(d.containers))
+
+	for id := range d.containers {
+		ids = append(ids, id)
+	}
+	d.mu.Unlock()
+
+	for _, id := range ids {
+		if err := d.removeContainer(ctx, id); err != nil {
+			return fmt.Errorf("remove container %s: %w", id, err)
+		}
+	}
+
+	if d.network == "" {
+		return nil
+	}
+
+	err := d.call(ctx, http.MethodDelete, "/networks/"+d.network, nil, nil, nil)
+	if err != nil && !errors.Is(err, errDockerNotFound) {
+		return fmt.Errorf("remove network %s: %w", d.network, err)
+	}
+
+	d.network = ""
+
+	return nil
+}
+
+// Execute implements interface and executes the script in a new container streaming its logs.
+// The sources are fetched in a container of the helper image since the job image may have no git,
+// the build directory is mounted into the containers at the same path.
+// The container is killed when the context is done.
+// Non-zero exit status of the script is returned as *ExitError.
+func (d *DockerExecutor) Execute(ctx context.Context, script string, output io.Writer) error {
+	image := d.options.Image
+
+	if Stage(ctx) == StageGetSources {
+		image = d.helperImage
+
+		if err := d.pullImage(ctx, image, output); err != nil {
+			return err
+		}
+	}
+
+	id, err := d.createContainer(ctx, &dockerContainerConfig{
+		Image:      image,
+		Entrypoint: []string{"sh", "-c", dockerShell, "sh"},
+		Cmd:        []string{script},
+		Env:        d.env,
+		WorkingDir: d.homeDir,
+		HostConfig: dockerHostConfig{Binds: d.binds(), NetworkMode: d.network},
+	})
+	if err != nil {
+		return fmt.Errorf("create container: %w", err)
+	}
+
+	defer func() {
+		removeCtx, cancel := context.WithTimeout(context.Background(), dockerRemoveTimeout)
+		defer cancel()
+
+		// the container is removed by Cleanup if it fails here.
+		_ = d.removeContainer(removeCtx, id)
+	}()
+
+	if err := d.call(ctx, http.MethodPost, "/containers/"+id+"/start", nil, nil, nil); err != nil {
+		return fmt.Errorf("start container: %w", err)
+	}
+
+	if err := d.streamLogs(ctx, id, output); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		return fmt.Errorf("container logs: %w", err)
+	}
+
+	var status struct {
+		StatusCode int `json:"StatusCode"`
+		Error      *struct {
+			Message string `json:"Message"`
+		} `json:"Error"`
+	}
+
+	if err := d.call(ctx, http.MethodPost, "/containers/"+id+"/wait", nil, nil, &status); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		return fmt.Errorf("wait container: %w", err)
+	}
+
+	if status.Error != nil && status.Error.Message != "" {
+		return fmt.Errorf("wait container: %s", status.Error.Message)
+	}
+
+	if status.StatusCode != 0 {
+		return &ExitError{Code: status.StatusCode}
+	}
+
+	return nil
+}
+
+// pullImage pulls the image according to the pull policy.
+func (d *DockerExecutor) pullImage(ctx context.Context, image string, output io.Writer) error {
+	policy := d.pullPolicy
+	if policy == "" {
+		policy = dockerPullPolicyIfNotPresent
+	}
+
+	switch policy {
+	case dockerPullPolicyIfNotPresent, dockerPullPolicyNever:
+		err := d.call(ctx, http.MethodGet, "/images/"+image+"/json", nil, nil, nil)
+		if err == nil {
+			fmt.Fprintf(output, "Using locally found image %s\n", image)
+			return nil
+		}
+
+		if !errors.Is(err, errDockerNotFound) {
+			return fmt.Errorf("inspect image: %w", err)
+		}
+
+		if policy == dockerPullPolicyNever {
+			return fmt.Errorf("image %s is not found locally and pull policy is %q", image, policy)
+		}
+	case dockerPullPolicyAlways:
+	default:
+		return fmt.Errorf("unknown pull policy %q", policy)
+	}
+
+	fmt.Fprintf(output, "Pulling docker image %s ...\n", image)
+
+	repository, tag := splitImage(image)
+
+	query := url.Values{"fromImage": {repository}}
+	if tag != "" {
+		query.Set("tag", tag)
+	}
+
+	resp, err := d.request(ctx, http.MethodPost, "/images/create", query, nil)
+	if err != nil {
+		return fmt.Errorf("pull image: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// the progress of the pull is streamed as JSON messages, the failure is reported by one of them.
+	decoder := json.NewDecoder(resp.Body)
+
+	for {
+		var message struct {
+			Error string `json:"error"`
+		}
+
+		if err := decoder.Decode(&message); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+
+			return fmt.Errorf("pull image: %w", err)
+		}
+
+		if message.Error != "" {
+			return fmt.Errorf("pull image: %s", message.Error)
+		}
+	}
+}
+
+// splitImage splits the image reference to the repository and the tag, the tag is "latest" by default.
+// The tag is empty when the image is referenced by the digest.
+func splitImage(image string) (string, string) {
+	if strings.Contains(image, "@") {
+		return image, ""
+	}
+
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i], image[i+1:]
+	}
+
+	return image, "latest"
+}
+
+// dockerContainerConfig container configuration of the Docker Engine API.
+type dockerContainerConfig struct {
+	Image            string                  `json:"Image"`
+	Entrypoint       []string                `json:"Entrypoint,omitempty"`
+	Cmd              []string                `json:"Cmd,omitempty"`
+	Env              []string                `json:"Env"`
+	WorkingDir       string                  `json:"WorkingDir,omitempty"`
+	HostConfig       dockerHostConfig        `json:"HostConfig"`
+	NetworkingConfig *dockerNetworkingConfig `json:"NetworkingConfig,omitempty"`
+}
+
+// dockerHostConfig host configuration of the container.
+type dockerHostConfig struct {
+	Binds       []string `json:"Binds,omitempty"`
+	NetworkMode string   `json:"NetworkMode,omitempty"`
+}
+
+// dockerNetworkingConfig networks to which the container is connected.
+type dockerNetworkingConfig struct {
+	EndpointsConfig map[string]dockerEndpointConfig `json:"EndpointsConfig"`
+}
+
+// dockerEndpointConfig connection of the container to the network.
+type dockerEndpointConfig struct {
+	Aliases []string `json:"Aliases"`
+}
+
+// binds returns the volumes mounted at the same paths.
+func (d *DockerExecutor) binds() []string {
+	binds := make([]string, 0, len(d.options.Volumes))
+	for _, volume := range d.options.Volumes {
+		binds = append(binds, volume+":"+volume)
+	}
+
+	return binds
+}
+
+// createContainer creates the container, it is removed by Cleanup unless it was removed before.
+func (d *DockerExecutor) createContainer(ctx context.Context, cfg *dockerContainerConfig) (string, error) {
+	var created struct {
+		ID string `json:"Id"`
+	}
+
+	if err := d.call(ctx, http.MethodPost, "/containers/create", nil, cfg, &created); err != nil {
+		return "", err
+	}
+
+	d.mu.Lock()
+	d.containers[created.ID] = struct{}{}
+	d.mu.Unlock()
+
+	return created.ID, nil
+}
+
+// removeContainer kills and removes the container.
+func (d *DockerExecutor) removeContainer(ctx context.Context, id string) error {
+	err := d.call(ctx, http.MethodDelete, "/containers/"+id, url.Values{"force": {"1"}}, nil, nil)
+	if err != nil && !errors.Is(err, errDockerNotFound) {
+		return err
+	}
+
+	d.mu.Lock()
+	delete(d.containers, id)
+	d.mu.Unlock()
+
+	return nil
+}
+
+// streamLogs follows stdout and stderr of the container until it exits.
+func (d *DockerExecutor) streamLogs(ctx context.Context, id string, output io.Writer) error {
+	query := url.Values{"follow": {"1"}, "stdout": {"1"}, "stderr": {"1"}}
+
+	resp, err := d.request(ctx, http.MethodGet, "/containers/"+id+"/logs", query, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return demuxStream(resp.Body, output)
+}
+
+// demuxStream copies the multiplexed stream of the container without TTY into the output,
+// every frame has 8 bytes header with the stream type and the big-endian size of the payload.
+func demuxStream(r io.Reader, output io.Writer) error {
+	header := make([]byte, 8)
+
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+
+			return fmt.Errorf("read header: %w", err)
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.CopyN(output, r, size); err != nil {
+			return fmt.Errorf("read frame: %w", err)
+		}
+	}
+}
+
+// dockerError represent error response of the Docker Engine API.
+type dockerError struct {
+	StatusCode int
+	Message    string `json:"message"`
+}
+
+// Error implements error interface.
+func (e *dockerError) Error() string {
+	return fmt.Sprintf("docker: %s (status %d)", e.Message, e.StatusCode)
+}
+
+// Is reports the missing objects as errDockerNotFound.
+func (e *dockerError) Is(target error) bool {
+	return target == errDockerNotFound && e.StatusCode == http.StatusNotFound
+}
+
+// call sends the request to the Docker Engine API and decodes the response into the result if it is not nil.
+func (d *DockerExecutor) call(
+	ctx context.Context,
+	method, path string,
+	query url.Values,
+	body, result interface{},
+) error {
+	resp, err := d.request(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if result == nil {
+		return nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("unmarshal response: %w", err)
+	}
+
+	return nil
+}
+
+// request sends the request to the Docker Engine API, unsuccessful responses are returned as *dockerError.
+func (d *DockerExecutor) request(
+	ctx context.Context,
+	method, path string,
+	query url.Values,
+	body interface{},
+) (*http.Response, error) {
+	var reader io.Reader
+
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("marshal request: %w", err)
+		}
+
+		reader = bytes.NewReader(data)
+	}
+
+	address := dockerAPIAddress + path
+	if len(query) > 0 {
+		address += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, address, reader)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("do request: %w", err)
+	}
+
+	// 304 is returned when the container is already started or stopped.
+	if resp.StatusCode >= http.StatusMultipleChoices && resp.StatusCode != http.StatusNotModified {
+		defer resp.Body.Close()
+
+		apiErr := &dockerError{StatusCode: resp.StatusCode}
+		if err := json.NewDecoder(io.LimitReader(resp.Body, dockerErrorSize)).Decode(apiErr); err != nil {
+			apiErr.Message = resp.Status
+		}
+
+		return nil, apiErr
+	}
+
+	return resp, nil
+}
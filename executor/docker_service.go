@@ -0,0 +1,196 @@
+package executor
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// serviceCheckInterval interval between connection attempts to the exposed ports of the service.
+const serviceCheckInterval = 100 * time.Millisecond
+
+// startServices creates the network of the job and starts the services on it,
+// the services are reachable from the job containers by their aliases.
+func (d *DockerExecutor) startServices(ctx context.Context, services []Service, output io.Writer) error {
+	if len(services) == 0 {
+		return nil
+	}
+
+	network, err := d.createNetwork(ctx)
+	if err != nil {
+		return fmt.Errorf("create network: %w", err)
+	}
+
+	d.network = network
+
+	ids := make([]string, 0, len(services))
+
+	for _, service := range services {
+		if err := d.pullImage(ctx, service.Image, output); err != nil {
+			return fmt.Errorf("service %s: %w", service.Image, err)
+		}
+
+		fmt.Fprintf(output, "Starting service %s ...\n", service.Image)
+
+		id, err := d.startService(ctx, service)
+		if err != nil {
+			return fmt.Errorf("service %s: %w", service.Image, err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	fmt.Fprintf(output, "Waiting for services to be up and running (timeout %s)...\n", d.waitTimeout)
+
+	// the services start in parallel, so they share the timeout.
+	waitCtx, cancel := context.WithTimeout(ctx, d.waitTimeout)
+	defer cancel()
+
+	for i, id := range ids {
+		if err := d.waitForService(waitCtx, id); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			// the port may be opened later or not be used by the job at all, so it is just a warning.
+			fmt.Fprintf(
+				output,
+				"%sWARNING: service %s probably didn't start properly: %s%s\n",
+				ansiBoldYellow,
+				services[i].Image,
+				err,
+				ansiReset,
+			)
+		}
+	}
+
+	return nil
+}
+
+// createNetwork creates the network of the job with a unique name.
+func (d *DockerExecutor) createNetwork(ctx context.Context) (string, error) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", fmt.Errorf("random name: %w", err)
+	}
+
+	name := "gitlab-runner-" + hex.EncodeToString(suffix)
+
+	body := struct {
+		Name           string `json:"Name"`
+		CheckDuplicate bool   `json:"CheckDuplicate"`
+	}{Name: name, CheckDuplicate: true}
+
+	if err := d.call(ctx, http.MethodPost, "/networks/create", nil, &body, nil); err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+// startService creates and starts the service container connected to the network of the job.
+func (d *DockerExecutor) startService(ctx context.Context, service Service) (string, error) {
+	id, err := d.createContainer(ctx, &dockerContainerConfig{
+		Image:      service.Image,
+		Entrypoint: service.Entrypoint,
+		Cmd:        service.Command,
+		Env:        service.Env,
+		HostConfig: dockerHostConfig{NetworkMode: d.network},
+		NetworkingConfig: &dockerNetworkingConfig{
+			EndpointsConfig: map[string]dockerEndpointConfig{
+				d.network: {Aliases: serviceAliases(service)},
+			},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("create container: %w", err)
+	}
+
+	if err := d.call(ctx, http.MethodPost, "/containers/"+id+"/start", nil, nil, nil); err != nil {
+		return "", fmt.Errorf("start container: %w", err)
+	}
+
+	return id, nil
+}
+
+// waitForService waits until all exposed TCP ports of the service accept connections.
+func (d *DockerExecutor) waitForService(ctx context.Context, id string) error {
+	var inspect struct {
+		Config struct {
+			ExposedPorts map[string]struct{} `json:"ExposedPorts"`
+		} `json:"Config"`
+		NetworkSettings struct {
+			Networks map[string]struct {
+				IPAddress string `json:"IPAddress"`
+			} `json:"Networks"`
+		} `json:"NetworkSettings"`
+	}
+
+	if err := d.call(ctx, http.MethodGet, "/containers/"+id+"/json", nil, nil, &inspect); err != nil {
+		return fmt.Errorf("inspect container: %w", err)
+	}
+
+	ip := inspect.NetworkSettings.Networks[d.network].IPAddress
+
+	for exposed := range inspect.Config.ExposedPorts {
+		port := strings.TrimSuffix(exposed, "/tcp")
+		if port == exposed {
+			continue
+		}
+
+		if ip == "" {
+			return fmt.Errorf("no address in network %s", d.network)
+		}
+
+		if err := waitForPort(ctx, net.JoinHostPort(ip, port)); err != nil {
+			return fmt.Errorf("port %s: %w", port, err)
+		}
+	}
+
+	return nil
+}
+
+// waitForPort tries to connect to the address until it succeeds or the context is done.
+func waitForPort(ctx context.Context, address string) error {
+	var dialer net.Dialer
+
+	ticker := time.NewTicker(serviceCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err == nil {
+			return conn.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-ticker.C:
+		}
+	}
+}
+
+// serviceAliases returns hostnames of the service, the image name without the tag is one of them
+// with "/" replaced by "__" and "-" since it is not allowed in hostnames.
+func serviceAliases(service Service) []string {
+	name, _ := splitImage(service.Image)
+	if i := strings.Index(name, "@"); i >= 0 {
+		name = name[:i]
+	}
+
+	aliases := append([]string{}, service.Aliases...)
+	aliases = append(aliases, strings.ReplaceAll(name, "/", "__"))
+
+	if strings.Contains(name, "/") {
+		aliases = append(aliases, strings.ReplaceAll(name, "/", "-"))
+	}
+
+	return aliases
+}
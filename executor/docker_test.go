@@ -0,0 +1,416 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ihippik/gitlab-runner/config"
+)
+
+// dockerFake fake Docker Engine API, the containers "run" the script by the run function.
+type dockerFake struct {
+	t   *testing.T
+	run func(ctx context.Context, script string) (string, int)
+
+	mu         sync.Mutex
+	images     map[string]bool
+	pulls      []string
+	containers map[string]*dockerContainerConfig
+	started    []string
+	removed    []string
+	exitCodes  map[string]int
+	networks   map[string]bool
+	ports      map[string][]string
+}
+
+// newDockerFake starts the fake Docker Engine API on a unix socket and returns its address.
+func newDockerFake(t *testing.T, run func(ctx context.Context, script string) (string, int)) (*dockerFake, string) {
+	t.Helper()
+
+	fake := &dockerFake{
+		t:          t,
+		run:        run,
+		images:     make(map[string]bool),
+		containers: make(map[string]*dockerContainerConfig),
+		exitCodes:  make(map[string]int),
+		networks:   make(map[string]bool),
+		ports:      make(map[string][]string),
+	}
+
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("unix sockets are not supported: %v", err)
+	}
+
+	srv := httptest.NewUnstartedServer(fake)
+	srv.Listener = listener
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	return fake, "unix://" + socket
+}
+
+// ServeHTTP implements http.Handler.
+func (f *dockerFake) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	switch {
+	case r.Method == http.MethodGet && parts[0] == "images" && parts[len(parts)-1] == "json":
+		if !f.images[strings.Join(parts[1:len(parts)-1], "/")] {
+			f.error(w, http.StatusNotFound, "no such image")
+		}
+	case r.Method == http.MethodPost && r.URL.Path == "/images/create":
+		image := r.URL.Query().Get("fromImage") + ":" + r.URL.Query().Get("tag")
+		f.pulls = append(f.pulls, image)
+
+		if strings.HasPrefix(image, "private/") {
+			fmt.Fprintln(w, `{"status":"Pulling from private"}`)
+			fmt.Fprintln(w, `{"error":"pull access denied"}`)
+
+			return
+		}
+
+		f.images[image] = true
+		fmt.Fprintln(w, `{"status":"Pulling from library"}`)
+		fmt.Fprintln(w, `{"status":"Downloaded newer image"}`)
+	case r.Method == http.MethodPost && r.URL.Path == "/containers/create":
+		var cfg dockerContainerConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			f.error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		id := fmt.Sprintf("container-%d", len(f.containers)+1)
+		f.containers[id] = &cfg
+
+		fmt.Fprintf(w, `{"Id":%q}`, id)
+	case r.Method == http.MethodPost && parts[0] == "containers" && parts[2] == "start":
+		f.started = append(f.started, parts[1])
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && parts[0] == "containers" && parts[2] == "json":
+		cfg := f.containers[parts[1]]
+
+		exposed := make(map[string]struct{})
+		for _, port := range f.ports[cfg.Image] {
+			exposed[port] = struct{}{}
+		}
+
+		// the services are reachable on the loopback interface.
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Config": map[string]interface{}{"ExposedPorts": exposed},
+			"NetworkSettings": map[string]interface{}{
+				"Networks": map[string]interface{}{cfg.HostConfig.NetworkMode: map[string]string{"IPAddress": "127.0.0.1"}},
+			},
+		})
+	case r.Method == http.MethodPost && r.URL.Path == "/networks/create":
+		var network struct {
+			Name string `json:"Name"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&network); err != nil {
+			f.error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		f.networks[network.Name] = true
+
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"Id":%q}`, network.Name)
+	case r.Method == http.MethodDelete && parts[0] == "networks":
+		delete(f.networks, parts[1])
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && parts[0] == "containers" && parts[2] == "logs":
+		cfg := f.containers[parts[1]]
+
+		// the script may block until the request is canceled, the lock is not held meanwhile.
+		f.mu.Unlock()
+		out, code := f.run(r.Context(), cfg.Cmd[0])
+		f.mu.Lock()
+
+		f.exitCodes[parts[1]] = code
+
+		for i, line := range strings.SplitAfter(out, "\n") {
+			// the odd lines are sent as stderr.
+			w.Write(dockerFrame(byte(1+i%2), line))
+		}
+	case r.Method == http.MethodPost && parts[0] == "containers" && parts[2] == "wait":
+		fmt.Fprintf(w, `{"StatusCode":%d}`, f.exitCodes[parts[1]])
+	case r.Method == http.MethodDelete && parts[0] == "containers":
+		assert.Equal(f.t, "1", r.URL.Query().Get("force"))
+		f.removed = append(f.removed, parts[1])
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.error(w, http.StatusNotFound, "page not found")
+	}
+}
+
+// error writes error response of the Docker Engine API.
+func (f *dockerFake) error(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"message":%q}`, message)
+}
+
+// dockerFrame builds frame of the multiplexed container stream.
+func dockerFrame(stream byte, payload string) []byte {
+	frame := make([]byte, 8, 8+len(payload))
+	frame[0] = stream
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(payload)))
+
+	return append(frame, payload...)
+}
+
+// newDockerExecutor creates docker executor connected to the fake Docker Engine API.
+func newDockerExecutor(t *testing.T, host string, cfg config.DockerCfg) *DockerExecutor {
+	t.Helper()
+
+	client, err := NewDockerClient(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewDockerExecutor(client, cfg)
+}
+
+func TestDockerExecutor_Execute(t *testing.T) {
+	fake, host := newDockerFake(t, func(_ context.Context, script string) (string, int) {
+		if script == "exit 3" {
+			return "", 3
+		}
+
+		return "hello\nworld\n", 0
+	})
+
+	d := newDockerExecutor(t, host, config.DockerCfg{Image: "alpine"})
+	d.HomeDirectory("/builds/project")
+	d.Environment([]string{"CI_JOB_NAME=test"})
+
+	var out bytes.Buffer
+
+	err := d.Prepare(context.Background(), Options{Volumes: []string{"/builds/project", "/builds/project.tmp"}}, &out)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "Pulling docker image alpine ...")
+	assert.Equal(t, []string{"alpine:latest"}, fake.pulls)
+
+	out.Reset()
+
+	assert.NoError(t, d.Execute(context.Background(), "echo hello && echo world >&2", &out))
+	assert.Equal(t, "hello\nworld\n", out.String())
+
+	cfg := fake.containers["container-1"]
+	if assert.NotNil(t, cfg) {
+		assert.Equal(t, "alpine", cfg.Image)
+		assert.Equal(t, []string{"echo hello && echo world >&2"}, cfg.Cmd)
+		assert.Equal(t, []string{"CI_JOB_NAME=test"}, cfg.Env)
+		assert.Equal(t, "/builds/project", cfg.WorkingDir)
+		assert.Equal(
+			t,
+			[]string{"/builds/project:/builds/project", "/builds/project.tmp:/builds/project.tmp"},
+			cfg.HostConfig.Binds,
+		)
+	}
+
+	err = d.Execute(context.Background(), "exit 3", &out)
+
+	var exitErr *ExitError
+	if assert.True(t, errors.As(err, &exitErr)) {
+		assert.Equal(t, 3, exitErr.Code)
+	}
+
+	// the sources are fetched in a container of the helper image, the job image may have no git.
+	out.Reset()
+
+	assert.NoError(t, d.Execute(WithStage(context.Background(), StageGetSources), "git fetch", &out))
+	assert.Contains(t, out.String(), "Pulling docker image "+defaultDockerHelperImage)
+	assert.Equal(t, []string{"alpine:latest", defaultDockerHelperImage}, fake.pulls)
+
+	cfg = fake.containers["container-3"]
+	if assert.NotNil(t, cfg) {
+		assert.Equal(t, defaultDockerHelperImage, cfg.Image)
+		assert.Equal(t, []string{"git fetch"}, cfg.Cmd)
+		assert.Equal(t, "/builds/project", cfg.WorkingDir)
+	}
+
+	// every container is removed right after the script.
+	assert.Equal(t, []string{"container-1", "container-2", "container-3"}, fake.removed)
+	assert.NoError(t, d.Cleanup(context.Background()))
+	assert.Len(t, fake.removed, 3)
+}
+
+func TestDockerExecutor_Execute_timeout(t *testing.T) {
+	fake, host := newDockerFake(t, func(ctx context.Context, _ string) (string, int) {
+		<-ctx.Done()
+		return "", 137
+	})
+
+	d := newDockerExecutor(t, host, config.DockerCfg{})
+	fake.images["golang:1.17"] = true
+
+	assert.NoError(t, d.Prepare(context.Background(), Options{Image: "golang:1.17"}, &bytes.Buffer{}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	err := d.Execute(ctx, "sleep 30", &bytes.Buffer{})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	// the container is killed and removed.
+	fake.mu.Lock()
+	assert.Equal(t, []string{"container-1"}, fake.removed)
+	fake.mu.Unlock()
+}
+
+func TestDockerExecutor_Prepare(t *testing.T) {
+	fake, host := newDockerFake(t, nil)
+	fake.images["golang:1.17"] = true
+
+	var out bytes.Buffer
+
+	// the local image is used.
+	d := newDockerExecutor(t, host, config.DockerCfg{})
+	assert.NoError(t, d.Prepare(context.Background(), Options{Image: "golang:1.17"}, &out))
+	assert.Contains(t, out.String(), "Using locally found image golang:1.17")
+	assert.Empty(t, fake.pulls)
+
+	// the image is always pulled.
+	d = newDockerExecutor(t, host, config.DockerCfg{PullPolicy: dockerPullPolicyAlways})
+	assert.NoError(t, d.Prepare(context.Background(), Options{Image: "golang:1.17"}, &out))
+	assert.Equal(t, []string{"golang:1.17"}, fake.pulls)
+
+	// the missing image is never pulled.
+	d = newDockerExecutor(t, host, config.DockerCfg{PullPolicy: dockerPullPolicyNever})
+	assert.Error(t, d.Prepare(context.Background(), Options{Image: "node"}, &out))
+	assert.Len(t, fake.pulls, 1)
+
+	// pull failure is reported in the stream.
+	d = newDockerExecutor(t, host, config.DockerCfg{})
+	err := d.Prepare(context.Background(), Options{Image: "private/image:v1"}, &out)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "pull access denied")
+	}
+
+	// no image.
+	assert.Error(t, d.Prepare(context.Background(), Options{}, &out))
+}
+
+func TestDockerExecutor_Prepare_services(t *testing.T) {
+	fake, host := newDockerFake(t, func(_ context.Context, _ string) (string, int) { return "", 0 })
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	fake.ports["postgres:14"] = []string{port + "/tcp"}
+
+	// nothing listens on the port of the redis.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, closedPort, _ := net.SplitHostPort(closed.Addr().String())
+	closed.Close()
+
+	fake.ports["registry.example.com/cache/redis:latest"] = []string{closedPort + "/tcp", "53/udp"}
+
+	d := newDockerExecutor(t, host, config.DockerCfg{Image: "alpine", ServicesWaitTimeout: 300 * time.Millisecond})
+
+	var out bytes.Buffer
+
+	err = d.Prepare(context.Background(), Options{
+		Services: []Service{
+			{Image: "postgres:14", Aliases: []string{"db"}, Env: []string{"POSTGRES_PASSWORD=secret"}},
+			{Image: "registry.example.com/cache/redis:latest", Command: []string{"redis-server", "--appendonly", "no"}},
+		},
+	}, &out)
+	assert.NoError(t, err)
+	assert.Contains(t, out.String(), "Starting service postgres:14 ...")
+	assert.Contains(t, out.String(), "WARNING: service registry.example.com/cache/redis:latest probably didn't start properly")
+	assert.NotContains(t, out.String(), "WARNING: service postgres:14")
+	assert.Len(t, fake.networks, 1)
+	assert.Equal(t, []string{"container-1", "container-2"}, fake.started)
+
+	postgres := fake.containers["container-1"]
+	if assert.NotNil(t, postgres) && assert.NotNil(t, postgres.NetworkingConfig) {
+		assert.Equal(t, []string{"POSTGRES_PASSWORD=secret"}, postgres.Env)
+		assert.Equal(
+			t,
+			[]string{"db", "postgres"},
+			postgres.NetworkingConfig.EndpointsConfig[postgres.HostConfig.NetworkMode].Aliases,
+		)
+	}
+
+	redis := fake.containers["container-2"]
+	if assert.NotNil(t, redis) && assert.NotNil(t, redis.NetworkingConfig) {
+		assert.Equal(t, []string{"redis-server", "--appendonly", "no"}, redis.Cmd)
+		assert.Equal(
+			t,
+			[]string{"registry.example.com__cache__redis", "registry.example.com-cache-redis"},
+			redis.NetworkingConfig.EndpointsConfig[redis.HostConfig.NetworkMode].Aliases,
+		)
+	}
+
+	// the job containers are connected to the network of the services.
+	assert.NoError(t, d.Execute(context.Background(), "psql -h db", &out))
+
+	job := fake.containers["container-3"]
+	if assert.NotNil(t, job) {
+		assert.Equal(t, postgres.HostConfig.NetworkMode, job.HostConfig.NetworkMode)
+	}
+
+	// the services and the network are removed.
+	assert.NoError(t, d.Cleanup(context.Background()))
+	assert.ElementsMatch(t, []string{"container-1", "container-2", "container-3"}, fake.removed)
+	assert.Empty(t, fake.networks)
+}
+
+func TestNewDockerClient(t *testing.T) {
+	_, err := NewDockerClient("")
+	assert.NoError(t, err)
+
+	_, err = NewDockerClient("tcp://127.0.0.1:2375")
+	assert.Error(t, err)
+}
+
+func TestSplitImage(t *testing.T) {
+	tests := []struct {
+		image      string
+		repository string
+		tag        string
+	}{
+		{image: "alpine", repository: "alpine", tag: "latest"},
+		{image: "golang:1.17", repository: "golang", tag: "1.17"},
+		{image: "registry.example.com:5000/group/image", repository: "registry.example.com:5000/group/image", tag: "latest"},
+		{image: "registry.example.com:5000/image:v1", repository: "registry.example.com:5000/image", tag: "v1"},
+		{image: "alpine@sha256:e1c082e3d3c45cccac829840a25941e679c25d438cc8412c2fa221cf1a824e6a", repository: "alpine@sha256:e1c082e3d3c45cccac829840a25941e679c25d438cc8412c2fa221cf1a824e6a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			repository, tag := splitImage(tt.image)
+			assert.Equal(t, tt.repository, repository)
+			assert.Equal(t, tt.tag, tag)
+		})
+	}
+}
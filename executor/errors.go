@@ -0,0 +1,38 @@
+package executor
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+// ExitError represent non-zero exit status of the executed script.
+type ExitError struct {
+	// Code exit code of the script.
+	Code int
+}
+
+// Error implements error interface.
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// exitError converts exit status of the finished process to ExitError, the process killed by a signal
+// gets exit code 128+signal as in the shell. Other errors are returned as is.
+func exitError(err error) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return &ExitError{Code: 128 + int(status.Signal())}
+	}
+
+	if exitErr.ExitCode() > 0 {
+		return &ExitError{Code: exitErr.ExitCode()}
+	}
+
+	return err
+}
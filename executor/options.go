@@ -0,0 +1,28 @@
+package executor
+
+// Options describe the environment in which the job scripts are executed.
+type Options struct {
+	// Image docker image of the job, only executors running the scripts in containers use it.
+	Image string
+	// Volumes host directories which must be available to the scripts at the same paths.
+	Volumes []string
+	// Hidden host paths with the files of the other jobs which must not be available to the scripts,
+	// the volumes inside them stay available. Only executors isolating the scripts on the host use them.
+	Hidden []string
+	// Services containers started next to the job, only executors running the scripts in containers use them.
+	Services []Service
+}
+
+// Service represent a container which runs next to the job, e.g. a database used by the tests.
+type Service struct {
+	// Image docker image of the service.
+	Image string
+	// Aliases hostnames of the service in addition to the ones derived from the image name.
+	Aliases []string
+	// Entrypoint overrides the entrypoint of the image when it is not empty.
+	Entrypoint []string
+	// Command overrides the command of the image when it is not empty.
+	Command []string
+	// Env environment of the service in KEY=VALUE form.
+	Env []string
+}
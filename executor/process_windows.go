@@ -0,0 +1,15 @@
+package executor
+
+import "os/exec"
+
+// setProcessGroup does nothing on windows.
+func setProcessGroup(_ *exec.Cmd) {}
+
+// killProcessGroup kills the command process.
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,523 @@
+//go:build linux
+// +build linux
+
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/ihippik/gitlab-runner/config"
+)
+
+const (
+	// sandboxInitName name of the runner process re-executed as the init process of the sandbox.
+	sandboxInitName = "gitlab-runner-sandbox-init"
+	// sandboxHostname host name of the sandbox.
+	sandboxHostname = "gitlab-runner-sandbox"
+	// sandboxErrorFd descriptor of the pipe through which the init process reports the failure of the setup.
+	sandboxErrorFd = 3
+	// sandboxTmpDir temporary directory which is private to every sandbox.
+	sandboxTmpDir = "/tmp"
+)
+
+// sandboxSpec describes the sandbox to its init process.
+type sandboxSpec struct {
+	Script       string   `json:"script"`
+	Dir          string   `json:"dir"`
+	Binds        []string `json:"binds"`
+	Hidden       []string `json:"hidden"`
+	ReadOnlyRoot bool     `json:"read_only_root"`
+	Network      bool     `json:"network"`
+}
+
+// SandboxExecutor represent executor which runs scripts on the host machine inside new user, mount,
+// PID, UTS, IPC and network namespaces. The scripts see only their own processes and the loopback interface,
+// the root user of the sandbox is mapped to the user of the runner.
+// The other builds, the caches and the runner config are hidden from the scripts and every sandbox
+// has its own /tmp, the rest of the host is writable unless the root is read-only by the config.
+// The runner re-executes itself as the init process of the sandbox, so InitSandbox must be called
+// at the beginning of main.
+type SandboxExecutor struct {
+	cfg        config.SandboxCfg
+	configFile string
+
+	homeDir string
+	env     []string
+	binds   []string
+	hidden  []string
+}
+
+// NewSandboxExecutor create new instance of sandbox executor, the config file of the runner
+// with its token is hidden from the scripts.
+func NewSandboxExecutor(cfg config.SandboxCfg, configFile string) *SandboxExecutor {
+	if configFile != "" {
+		if abs, err := filepath.Abs(configFile); err == nil {
+			configFile = abs
+		}
+	}
+
+	return &SandboxExecutor{cfg: cfg, configFile: configFile}
+}
+
+// HomeDirectory set home directory.
+func (s *SandboxExecutor) HomeDirectory(dir string) {
+	s.homeDir = dir
+}
+
+// Environment set job environment in KEY=VALUE form, only PATH of the runner environment is passed into the sandbox.
+func (s *SandboxExecutor) Environment(env []string) {
+	s.env = env
+}
+
+// Prepare implements interface and remembers the directories of the job which are bind-mounted into the sandbox
+// and the paths which are hidden from it.
+func (s *SandboxExecutor) Prepare(_ context.Context, options Options, output io.Writer) error {
+	s.binds = options.Volumes
+	s.hidden = options.Hidden
+
+	if s.configFile != "" {
+		s.hidden = append(s.hidden, s.configFile)
+	}
+
+	fmt.Fprintln(output, "Using Sandbox executor...")
+
+	return nil
+}
+
+// Cleanup implements interface, the namespaces are gone along with the processes of the scripts.
+func (s *SandboxExecutor) Cleanup(_ context.Context) error {
+	return nil
+}
+
+// Execute implements interface and executes the script in a new sandbox streaming its output.
+// The sources are fetched with the host network, the job scripts only if it is allowed by the config.
+// The whole sandbox is killed when the context is done.
+// Non-zero exit status of the script is returned as *ExitError.
+func (s *SandboxExecutor) Execute(ctx context.Context, script string, output io.Writer) error {
+	path, err := writeScript(script)
+	if err != nil {
+		return fmt.Errorf("write script: %w", err)
+	}
+	defer os.Remove(path)
+
+	network := s.cfg.Network || Stage(ctx) == StageGetSources
+
+	spec, err := json.Marshal(sandboxSpec{
+		Script:       path,
+		Dir:          s.homeDir,
+		Binds:        s.binds,
+		Hidden:       s.hidden,
+		ReadOnlyRoot: s.cfg.ReadOnlyRoot,
+		Network:      network,
+	})
+	if err != nil {
+		return fmt.Errorf("marshal spec: %w", err)
+	}
+
+	errReader, errWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("pipe: %w", err)
+	}
+	defer errReader.Close()
+
+	cmd := &exec.Cmd{
+		Path:       "/proc/self/exe",
+		Args:       []string{sandboxInitName, string(spec)},
+		Env:        append([]string{"PATH=" + os.Getenv("PATH"), "HOME=" + s.homeDir}, s.env...),
+		Stdout:     output,
+		Stderr:     output,
+		ExtraFiles: []*os.File{errWriter},
+	}
+
+	flags := syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC
+	if !network {
+		flags |= syscall.CLONE_NEWNET
+	}
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  uintptr(flags),
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+	}
+
+	err = runProcess(ctx, cmd)
+	errWriter.Close()
+
+	if ctx.Err() == nil {
+		if setupErr, _ := io.ReadAll(errReader); len(setupErr) > 0 {
+			// the init process exits with 1 when the setup fails, it is not the exit status of the script.
+			return fmt.Errorf("sandbox: %s", setupErr)
+		}
+	}
+
+	return err
+}
+
+// InitSandbox runs the init process of the sandbox if the runner was re-executed by the SandboxExecutor,
+// in which case it never returns.
+func InitSandbox() {
+	if len(os.Args) != 2 || os.Args[0] != sandboxInitName {
+		return
+	}
+
+	// the scripts must not inherit the pipe.
+	syscall.CloseOnExec(sandboxErrorFd)
+	errFile := os.NewFile(sandboxErrorFd, "sandbox-error")
+
+	code, err := initSandbox(os.Args[1])
+	if err != nil {
+		fmt.Fprint(errFile, err)
+		os.Exit(1)
+	}
+
+	os.Exit(code)
+}
+
+// initSandbox sets up the namespaces and runs the script, it returns the exit code of the script.
+func initSandbox(rawSpec string) (int, error) {
+	var spec sandboxSpec
+
+	if err := json.Unmarshal([]byte(rawSpec), &spec); err != nil {
+		return 0, fmt.Errorf("unmarshal spec: %w", err)
+	}
+
+	// the script is read before the temporary directory of the host is hidden.
+	script, err := os.ReadFile(spec.Script)
+	if err != nil {
+		return 0, fmt.Errorf("read script: %w", err)
+	}
+
+	// the mounts of the sandbox must not propagate to the host.
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return 0, fmt.Errorf("make mounts private: %w", err)
+	}
+
+	if err := hidePaths(spec.Hidden, spec.Binds); err != nil {
+		return 0, err
+	}
+
+	if spec.ReadOnlyRoot {
+		if err := mountReadOnly(spec.Binds); err != nil {
+			return 0, err
+		}
+	}
+
+	// the private /tmp stays writable with the read-only root.
+	if err := mountTmp(spec.Binds); err != nil {
+		return 0, err
+	}
+
+	scriptPath := filepath.Join(sandboxTmpDir, filepath.Base(spec.Script))
+	if err := os.WriteFile(scriptPath, script, 0o600); err != nil {
+		return 0, fmt.Errorf("write script: %w", err)
+	}
+
+	// the processes of the host are hidden by the proc of the new PID namespace.
+	if err := unix.Mount("proc", "/proc", "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+		return 0, fmt.Errorf("mount proc: %w", err)
+	}
+
+	if !spec.Network {
+		if err := loopbackUp(); err != nil {
+			return 0, fmt.Errorf("loopback up: %w", err)
+		}
+	}
+
+	if err := unix.Sethostname([]byte(sandboxHostname)); err != nil {
+		return 0, fmt.Errorf("set hostname: %w", err)
+	}
+
+	cmd := exec.Command("bash", "--noprofile", "--norc", scriptPath)
+	cmd.Dir = spec.Dir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// the mounts become locked in the nested user namespace, so the script can not make them writable again.
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: 0, Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: 0, Size: 1}},
+	}
+
+	err = cmd.Run()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal()), nil
+		}
+
+		return exitErr.ExitCode(), nil
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("run script: %w", err)
+	}
+
+	return 0, nil
+}
+
+// hidePaths covers the directories by empty read-only tmpfs and the files by /dev/null,
+// the binds inside the hidden directories are mounted back on top of the tmpfs.
+func hidePaths(hidden, binds []string) error {
+	const hiddenFlags = unix.MS_NOSUID | unix.MS_NODEV | unix.MS_NOEXEC
+
+	var dirs []string
+
+	err := coverPaths(hidden, binds, func() error {
+		for _, path := range hidden {
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+
+			if !info.IsDir() {
+				if err := unix.Mount("/dev/null", path, "", unix.MS_BIND, ""); err != nil {
+					return fmt.Errorf("hide %s: %w", path, err)
+				}
+
+				continue
+			}
+
+			if err := unix.Mount("tmpfs", path, "tmpfs", hiddenFlags, "mode=0755"); err != nil {
+				return fmt.Errorf("hide %s: %w", path, err)
+			}
+
+			dirs = append(dirs, path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// the scripts can not leave files next to the other builds.
+	for _, dir := range dirs {
+		if err := unix.Mount("", dir, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY|hiddenFlags, ""); err != nil {
+			return fmt.Errorf("remount %s read-only: %w", dir, err)
+		}
+	}
+
+	return nil
+}
+
+// mountTmp mounts empty tmpfs on /tmp, so the sandboxes do not share the temporary files.
+// The binds inside /tmp are mounted back on top of the tmpfs.
+func mountTmp(binds []string) error {
+	return coverPaths([]string{sandboxTmpDir}, binds, func() error {
+		if err := unix.Mount("tmpfs", sandboxTmpDir, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=1777"); err != nil {
+			return fmt.Errorf("mount %s: %w", sandboxTmpDir, err)
+		}
+
+		return nil
+	})
+}
+
+// coverPaths mounts over the paths by the cover function and mounts the binds inside the paths back on top.
+func coverPaths(paths, binds []string, cover func() error) error {
+	// the binds are opened before they are covered, so they can be mounted back from the descriptors.
+	fds := make(map[string]int, len(binds))
+
+	for _, dir := range binds {
+		if !isSubpathOfAny(dir, paths) {
+			continue
+		}
+
+		fd, err := unix.Open(dir, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if errors.Is(err, unix.ENOENT) {
+			continue
+		}
+
+		if err != nil {
+			return fmt.Errorf("open %s: %w", dir, err)
+		}
+		defer unix.Close(fd)
+
+		fds[dir] = fd
+	}
+
+	if err := cover(); err != nil {
+		return err
+	}
+
+	for _, dir := range binds {
+		fd, ok := fds[dir]
+		if !ok {
+			continue
+		}
+
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("make mount point %s: %w", dir, err)
+		}
+
+		if err := unix.Mount("/proc/self/fd/"+strconv.Itoa(fd), dir, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			return fmt.Errorf("bind %s: %w", dir, err)
+		}
+	}
+
+	return nil
+}
+
+// mountReadOnly makes all the mounts read-only except the directories of the job and proc.
+func mountReadOnly(binds []string) error {
+	var writable []string
+
+	// the directories are mounted onto themselves to stay writable.
+	for _, dir := range binds {
+		if _, err := os.Stat(dir); err != nil {
+			continue
+		}
+
+		if err := unix.Mount(dir, dir, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			return fmt.Errorf("bind %s: %w", dir, err)
+		}
+
+		writable = append(writable, dir)
+	}
+
+	mounts, err := mountPoints()
+	if err != nil {
+		return err
+	}
+
+	for _, mount := range mounts {
+		if isSubpath(mount, "/proc") || isSubpathOfAny(mount, writable) {
+			continue
+		}
+
+		var stat unix.Statfs_t
+
+		if err := unix.Statfs(mount, &stat); err != nil {
+			return fmt.Errorf("statfs %s: %w", mount, err)
+		}
+
+		flags := unix.MS_BIND | unix.MS_REMOUNT | unix.MS_RDONLY | preservedMountFlags(int64(stat.Flags))
+		if err := unix.Mount("", mount, "", flags, ""); err != nil {
+			return fmt.Errorf("remount %s read-only: %w", mount, err)
+		}
+	}
+
+	return nil
+}
+
+// preservedMountFlags returns the flags of the mount which are locked for the sandbox and must be kept on remount.
+func preservedMountFlags(statFlags int64) uintptr {
+	var flags uintptr
+
+	for _, f := range []struct {
+		stat  int64
+		mount uintptr
+	}{
+		{unix.ST_NOSUID, unix.MS_NOSUID},
+		{unix.ST_NODEV, unix.MS_NODEV},
+		{unix.ST_NOEXEC, unix.MS_NOEXEC},
+		{unix.ST_NOATIME, unix.MS_NOATIME},
+		{unix.ST_NODIRATIME, unix.MS_NODIRATIME},
+		{unix.ST_RELATIME, unix.MS_RELATIME},
+	} {
+		if statFlags&f.stat != 0 {
+			flags |= f.mount
+		}
+	}
+
+	if statFlags&(unix.ST_NOATIME|unix.ST_RELATIME) == 0 {
+		flags |= unix.MS_STRICTATIME
+	}
+
+	return flags
+}
+
+// mountPoints returns the mount points of the current mount namespace.
+func mountPoints() ([]string, error) {
+	data, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, fmt.Errorf("read mountinfo: %w", err)
+	}
+
+	var mounts []string
+
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+
+		mounts = append(mounts, unescapeMountPoint(fields[4]))
+	}
+
+	return mounts, nil
+}
+
+// unescapeMountPoint decodes the octal escapes of the spaces and other special characters of the mount point.
+func unescapeMountPoint(s string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+
+				continue
+			}
+		}
+
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
+
+// isSubpath reports whether the path is the directory or is inside it.
+func isSubpath(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// isSubpathOfAny reports whether the path is inside any of the directories.
+func isSubpathOfAny(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if isSubpath(path, dir) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// loopbackUp brings up the loopback interface of the new network namespace.
+func loopbackUp() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("socket: %w", err)
+	}
+	defer unix.Close(fd)
+
+	ifreq, err := unix.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifreq); err != nil {
+		return fmt.Errorf("get flags: %w", err)
+	}
+
+	ifreq.SetUint16(ifreq.Uint16() | unix.IFF_UP)
+
+	if err := unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifreq); err != nil {
+		return fmt.Errorf("set flags: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,254 @@
+//go:build linux
+// +build linux
+
+package executor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ihippik/gitlab-runner/config"
+)
+
+func TestMain(m *testing.M) {
+	// the test binary is re-executed as the init process of the sandbox.
+	InitSandbox()
+
+	os.Exit(m.Run())
+}
+
+// newSandbox returns the prepared sandbox executor, the test is skipped if the namespaces are not available.
+func newSandbox(t *testing.T, cfg config.SandboxCfg, volumes ...string) *SandboxExecutor {
+	t.Helper()
+
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not installed")
+	}
+
+	s := NewSandboxExecutor(cfg, "")
+
+	if err := s.Prepare(context.Background(), Options{Volumes: volumes}, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	var exitErr *ExitError
+	if err := s.Execute(context.Background(), "true", ioutil.Discard); err != nil && !errors.As(err, &exitErr) {
+		t.Skipf("namespaces are not available: %v", err)
+	}
+
+	return s
+}
+
+func TestSandboxExecutor(t *testing.T) {
+	dir := t.TempDir()
+
+	s := newSandbox(t, config.SandboxCfg{}, dir)
+	s.HomeDirectory(dir)
+	s.Environment([]string{"CI_JOB_NAME=test"})
+
+	var out bytes.Buffer
+
+	assert.NoError(t, s.Execute(context.Background(), "echo $CI_JOB_NAME; pwd >&2; hostname", &out))
+	assert.Equal(t, "test\n"+dir+"\n"+sandboxHostname+"\n", out.String())
+
+	// the runner environment is not passed into the sandbox.
+	assert.NoError(t, os.Setenv("RUNNER_SECRET", "secret"))
+	defer os.Unsetenv("RUNNER_SECRET")
+
+	out.Reset()
+
+	assert.NoError(t, s.Execute(context.Background(), `echo "[$RUNNER_SECRET]"`, &out))
+	assert.Equal(t, "[]\n", out.String())
+
+	err := s.Execute(context.Background(), "exit 3", &out)
+
+	var exitErr *ExitError
+	if assert.True(t, errors.As(err, &exitErr)) {
+		assert.Equal(t, 3, exitErr.Code)
+	}
+
+	// the processes of the host are not visible, the runner is the init process of the new PID namespace.
+	out.Reset()
+
+	assert.NoError(t, s.Execute(context.Background(), "cat /proc/1/cmdline | tr '\\0' ' '", &out))
+	assert.True(t, strings.HasPrefix(out.String(), sandboxInitName+" "), out.String())
+}
+
+func TestSandboxExecutor_network(t *testing.T) {
+	var hostNet syscall.Stat_t
+	if err := syscall.Stat("/proc/self/ns/net", &hostNet); err != nil {
+		t.Skipf("network namespace is unknown: %v", err)
+	}
+
+	hostNetID := strconv.FormatUint(hostNet.Ino, 10) + "\n"
+
+	s := newSandbox(t, config.SandboxCfg{})
+
+	var out bytes.Buffer
+
+	// the job scripts have the loopback interface only.
+	assert.NoError(t, s.Execute(context.Background(), "stat -Lc %i /proc/self/ns/net", &out))
+	assert.NotEqual(t, hostNetID, out.String())
+
+	out.Reset()
+
+	assert.NoError(t, s.Execute(context.Background(), "grep -c : /proc/net/dev; grep lo: /proc/net/dev >/dev/null", &out))
+	assert.Equal(t, "1\n", out.String())
+
+	// the sources are fetched with the host network.
+	out.Reset()
+
+	ctx := WithStage(context.Background(), StageGetSources)
+	assert.NoError(t, s.Execute(ctx, "stat -Lc %i /proc/self/ns/net", &out))
+	assert.Equal(t, hostNetID, out.String())
+
+	// the host network is allowed by the config.
+	out.Reset()
+
+	s = newSandbox(t, config.SandboxCfg{Network: true})
+	assert.NoError(t, s.Execute(context.Background(), "stat -Lc %i /proc/self/ns/net", &out))
+	assert.Equal(t, hostNetID, out.String())
+}
+
+func TestSandboxExecutor_readOnlyRoot(t *testing.T) {
+	buildDir := t.TempDir()
+
+	// the sandbox has its own /tmp, so the host directory is created next to the sources.
+	hostDir, err := os.MkdirTemp(".", "host-")
+	if err != nil {
+		t.Skipf("working directory is not writable: %v", err)
+	}
+	defer os.RemoveAll(hostDir)
+
+	hostDir, _ = filepath.Abs(hostDir)
+
+	s := newSandbox(t, config.SandboxCfg{ReadOnlyRoot: true}, buildDir)
+	s.HomeDirectory(buildDir)
+
+	var out bytes.Buffer
+
+	// the build directory stays writable.
+	assert.NoError(t, s.Execute(context.Background(), "echo built > artifact", &out))
+
+	data, err := os.ReadFile(filepath.Join(buildDir, "artifact"))
+	assert.NoError(t, err)
+	assert.Equal(t, "built\n", string(data))
+
+	// the rest of the host is read-only.
+	err = s.Execute(context.Background(), "touch "+Quote(filepath.Join(hostDir, "file")), &out)
+
+	var exitErr *ExitError
+	assert.True(t, errors.As(err, &exitErr))
+	assert.Contains(t, out.String(), "Read-only file system")
+	assertNotExist(t, filepath.Join(hostDir, "file"))
+
+	// the script can not make the host writable again.
+	if _, err := exec.LookPath("mount"); err == nil {
+		out.Reset()
+
+		err = s.Execute(context.Background(), "mount -o remount,bind,rw /", &out)
+		assert.True(t, errors.As(err, &exitErr), out.String())
+	}
+}
+
+func TestSandboxExecutor_hidden(t *testing.T) {
+	buildsDir := t.TempDir()
+	buildDir := filepath.Join(buildsDir, "runner", "0", "project")
+	otherDir := filepath.Join(buildsDir, "runner", "1", "other")
+	configFile := filepath.Join(t.TempDir(), "config.yml")
+
+	for _, dir := range []string{buildDir, buildDir + ".tmp", otherDir + ".tmp"} {
+		assert.NoError(t, os.MkdirAll(dir, 0o755))
+	}
+
+	assert.NoError(t, os.WriteFile(filepath.Join(buildDir+".tmp", "KUBECONFIG"), []byte("job secret"), 0o600))
+	assert.NoError(t, os.WriteFile(filepath.Join(otherDir+".tmp", "KUBECONFIG"), []byte("other secret"), 0o600))
+	assert.NoError(t, os.WriteFile(configFile, []byte("token: runner-token"), 0o600))
+
+	volumes := []string{buildDir, buildDir + ".tmp"}
+
+	s := newSandbox(t, config.SandboxCfg{}, volumes...)
+	s.configFile = configFile
+	s.HomeDirectory(buildDir)
+
+	assert.NoError(t, s.Prepare(context.Background(), Options{Volumes: volumes, Hidden: []string{buildsDir}}, ioutil.Discard))
+
+	var out bytes.Buffer
+
+	// the directories of the job stay available and writable.
+	assert.NoError(t, s.Execute(context.Background(), "cat ../project.tmp/KUBECONFIG; echo built > artifact", &out))
+	assert.Equal(t, "job secret", out.String())
+
+	data, err := os.ReadFile(filepath.Join(buildDir, "artifact"))
+	assert.NoError(t, err)
+	assert.Equal(t, "built\n", string(data))
+
+	// the other builds and the runner config are hidden even though the root is writable.
+	out.Reset()
+
+	// the config may be missing at all when it is in the temporary directory of the host.
+	script := "ls -A " + Quote(filepath.Join(buildsDir, "runner")) + "; cat " + Quote(configFile) + " 2>/dev/null; true"
+	assert.NoError(t, s.Execute(context.Background(), script, &out))
+	assert.Equal(t, "0\n", out.String())
+
+	_ = s.Execute(context.Background(), "touch "+Quote(filepath.Join(buildsDir, "file")), &out)
+	assertNotExist(t, filepath.Join(buildsDir, "file"))
+}
+
+func TestSandboxExecutor_tmp(t *testing.T) {
+	hostFile, err := os.CreateTemp(sandboxTmpDir, "host-*")
+	if err != nil {
+		t.Skipf("%s is not writable: %v", sandboxTmpDir, err)
+	}
+
+	hostFile.Close()
+	defer os.Remove(hostFile.Name())
+
+	buildDir := t.TempDir()
+	sandboxFile := hostFile.Name() + ".sandbox"
+
+	s := newSandbox(t, config.SandboxCfg{ReadOnlyRoot: true}, buildDir)
+	s.HomeDirectory(buildDir)
+
+	var out bytes.Buffer
+
+	// every sandbox has its own writable /tmp, the build directory stays available even if it is inside /tmp.
+	script := "test ! -e " + Quote(hostFile.Name()) + " && touch " + Quote(sandboxFile) + " && echo built > artifact"
+	assert.NoError(t, s.Execute(context.Background(), script, &out), out.String())
+	assertNotExist(t, sandboxFile)
+
+	data, err := os.ReadFile(filepath.Join(buildDir, "artifact"))
+	assert.NoError(t, err)
+	assert.Equal(t, "built\n", string(data))
+}
+
+func TestSandboxExecutor_timeout(t *testing.T) {
+	s := newSandbox(t, config.SandboxCfg{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+
+	err := s.Execute(ctx, "sleep 30 & sleep 30; wait", ioutil.Discard)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestUnescapeMountPoint(t *testing.T) {
+	assert.Equal(t, "/mnt/my disk", unescapeMountPoint(`/mnt/my\040disk`))
+	assert.Equal(t, `/mnt/a\b`, unescapeMountPoint(`/mnt/a\134b`))
+	assert.Equal(t, `/mnt/end\04`, unescapeMountPoint(`/mnt/end\04`))
+}
@@ -0,0 +1,47 @@
+//go:build !linux
+// +build !linux
+
+package executor
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/ihippik/gitlab-runner/config"
+)
+
+// errSandboxUnsupported the namespaces are the feature of the linux kernel.
+var errSandboxUnsupported = errors.New("sandbox executor is supported only on linux")
+
+// SandboxExecutor represent executor which runs scripts inside the linux namespaces, it always fails on this system.
+type SandboxExecutor struct{}
+
+// NewSandboxExecutor create new instance of sandbox executor.
+func NewSandboxExecutor(_ config.SandboxCfg, _ string) *SandboxExecutor {
+	return &SandboxExecutor{}
+}
+
+// HomeDirectory set home directory.
+func (s *SandboxExecutor) HomeDirectory(_ string) {}
+
+// Environment set job environment in KEY=VALUE form.
+func (s *SandboxExecutor) Environment(_ []string) {}
+
+// Prepare implements interface and reports that the sandbox is not supported.
+func (s *SandboxExecutor) Prepare(_ context.Context, _ Options, _ io.Writer) error {
+	return errSandboxUnsupported
+}
+
+// Execute implements interface and reports that the sandbox is not supported.
+func (s *SandboxExecutor) Execute(_ context.Context, _ string, _ io.Writer) error {
+	return errSandboxUnsupported
+}
+
+// Cleanup implements interface.
+func (s *SandboxExecutor) Cleanup(_ context.Context) error {
+	return nil
+}
+
+// InitSandbox does nothing on this system.
+func InitSandbox() {}
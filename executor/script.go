@@ -0,0 +1,103 @@
+package executor
+
+import (
+	"fmt"
+	"strings"
+)
+
+// some colors of the echoed commands and warnings.
+const (
+	ansiBoldGreen  = "\033[32;1m"
+	ansiBoldYellow = "\033[33;1m"
+	ansiReset      = "\033[0;m"
+)
+
+// Script represent a bash script assembled from all commands of the job step.
+// The commands run in a single shell, so the working directory, exported variables
+// and shell functions persist between them.
+type Script struct {
+	// Dir working directory of the script, the current directory is used when empty.
+	Dir string
+	// Variables exported in the prologue of the script in KEY=VALUE form.
+	Variables []string
+	// Commands executed one by one, the script stops on the first failed command.
+	Commands []string
+	// Quiet disables echoing of the commands.
+	Quiet bool
+}
+
+// String generates the source of the script.
+func (s Script) String() string {
+	var b strings.Builder
+
+	// prologue
+	b.WriteString("#!/usr/bin/env bash\n\n")
+	b.WriteString("set -eo pipefail\n")
+	b.WriteString("set +o noclobber\n")
+
+	for _, variable := range s.Variables {
+		key, value := splitVariable(variable)
+		fmt.Fprintf(&b, "export %s=%s\n", key, Quote(value))
+	}
+
+	if s.Dir != "" {
+		fmt.Fprintf(&b, "cd %s\n", Quote(s.Dir))
+	}
+
+	b.WriteString("\n")
+
+	for _, command := range s.Commands {
+		command = strings.TrimSpace(command)
+		if command == "" {
+			continue
+		}
+
+		if !s.Quiet {
+			fmt.Fprintf(&b, "printf '%%s\\n' %s\n", Quote(ansiBoldGreen+"$ "+command+ansiReset))
+		}
+
+		b.WriteString(command + "\n")
+	}
+
+	// epilogue
+	b.WriteString("\nexit 0\n")
+
+	return b.String()
+}
+
+// exportScript prepends export of the environment and change of the working directory to the script,
+// so it can be executed on another machine where the environment of the runner is not available.
+func exportScript(env []string, dir, script string) string {
+	var b strings.Builder
+
+	b.WriteString("#!/usr/bin/env bash\n\n")
+
+	for _, variable := range env {
+		key, value := splitVariable(variable)
+		fmt.Fprintf(&b, "export %s=%s\n", key, Quote(value))
+	}
+
+	if dir != "" {
+		fmt.Fprintf(&b, "cd %s || exit 1\n", Quote(dir))
+	}
+
+	b.WriteString("\n")
+	b.WriteString(script)
+
+	return b.String()
+}
+
+// splitVariable splits KEY=VALUE variable.
+func splitVariable(variable string) (string, string) {
+	parts := strings.SplitN(variable, "=", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+
+	return parts[0], parts[1]
+}
+
+// Quote quotes the string for bash using single quotes.
+func Quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
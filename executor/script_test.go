@@ -0,0 +1,54 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScript_String(t *testing.T) {
+	script := Script{
+		Variables: []string{"GREETING=it's me"},
+		Commands:  []string{"echo $GREETING", ""},
+	}
+
+	assert.Equal(
+		t,
+		"#!/usr/bin/env bash\n\n"+
+			"set -eo pipefail\n"+
+			"set +o noclobber\n"+
+			"export GREETING='it'\\''s me'\n"+
+			"\n"+
+			"printf '%s\\n' '\x1b[32;1m$ echo $GREETING\x1b[0;m'\n"+
+			"echo $GREETING\n"+
+			"\nexit 0\n",
+		script.String(),
+	)
+}
+
+func TestScript_state(t *testing.T) {
+	dir := t.TempDir()
+	s := NewShellExecutor()
+	s.HomeDirectory(dir)
+
+	script := Script{
+		Commands: []string{
+			"mkdir sub && cd sub",
+			"export NAME=runner",
+			"greet() { echo \"hello $*\"; }",
+			"greet $NAME from $(basename $(pwd))",
+			"false | true",
+			"echo unreachable",
+		},
+	}
+
+	var out bytes.Buffer
+
+	err := s.Execute(context.Background(), script.String(), &out)
+	assert.Error(t, err)
+	assert.Contains(t, out.String(), "hello runner from sub\n")
+	assert.Contains(t, out.String(), "$ false | true")
+	assert.NotContains(t, out.String(), "unreachable\n")
+}
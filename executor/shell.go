@@ -3,12 +3,16 @@ package executor
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"os"
 	"os/exec"
 )
 
 // ShellExecutor represent executor which runs scripts on the host machine.
 type ShellExecutor struct {
 	homeDir string
+	env     []string
 }
 
 // NewShellExecutor create new instance of shell executor.
@@ -16,25 +20,95 @@ func NewShellExecutor() *ShellExecutor {
 	return &ShellExecutor{}
 }
 
-// Execute implements interface and execute job.
-func (s *ShellExecutor) Execute(_ context.Context, command string) (string, error) {
+// Prepare implements interface, scripts are executed on the host so there is nothing to prepare.
+func (s *ShellExecutor) Prepare(_ context.Context, _ Options, _ io.Writer) error {
+	return nil
+}
+
+// Cleanup implements interface, the shell executor leaves nothing behind.
+func (s *ShellExecutor) Cleanup(_ context.Context) error {
+	return nil
+}
+
+// Execute implements interface and execute job streaming its output.
+// The script is saved into a temporary file and executed by a single bash process,
+// the whole process tree is killed when the context is done.
+// Non-zero exit status of the script is returned as *ExitError.
+func (s *ShellExecutor) Execute(ctx context.Context, script string, output io.Writer) error {
 	// TODO (k.makarov): linux edition
-	cmd := exec.Command("bash", "-c", command)
+	path, err := writeScript(script)
+	if err != nil {
+		return fmt.Errorf("write script: %w", err)
+	}
+	defer os.Remove(path)
+
+	cmd := exec.Command("bash", "--noprofile", "--norc", path)
 	cmd.Dir = s.homeDir
-	output, err := cmd.CombinedOutput()
+	cmd.Env = append(os.Environ(), s.env...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+
+	return runProcess(ctx, cmd)
+}
+
+// runProcess runs the command in its own process group, the whole group is killed when the context is done.
+// Non-zero exit status of the command is returned as *ExitError.
+func runProcess(ctx context.Context, cmd *exec.Cmd) error {
+	setProcessGroup(cmd)
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start: %w", err)
+	}
+
+	done := make(chan error, 1)
 
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return exitError(err)
+	case <-ctx.Done():
+		if err := killProcessGroup(cmd); err != nil {
+			return fmt.Errorf("kill process: %w", err)
+		}
+
+		<-done
+
+		return ctx.Err()
+	}
+}
+
+// writeScript saves the script into a temporary file.
+func writeScript(script string) (string, error) {
+	file, err := os.CreateTemp("", "gitlab-runner-script-*.sh")
 	if err != nil {
-		return string(output), err
+		return "", fmt.Errorf("create file: %w", err)
 	}
 
-	if len(output) == 0 {
-		output = []byte("ok")
+	if _, err := file.WriteString(script); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+
+		return "", fmt.Errorf("write file: %w", err)
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+
+		return "", fmt.Errorf("close file: %w", err)
 	}
 
-	return string(output), nil
+	return file.Name(), nil
 }
 
 // HomeDirectory set home directory.
 func (s *ShellExecutor) HomeDirectory(dir string) {
 	s.homeDir = dir
 }
+
+// Environment set job environment in KEY=VALUE form, it extends the runner environment.
+func (s *ShellExecutor) Environment(env []string) {
+	s.env = env
+}
@@ -0,0 +1,57 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShellExecutor_Execute(t *testing.T) {
+	s := NewShellExecutor()
+	s.HomeDirectory(t.TempDir())
+
+	var out bytes.Buffer
+
+	err := s.Execute(context.Background(), "echo hello && echo world >&2", &out)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\nworld\n", out.String())
+
+	err = s.Execute(context.Background(), "exit 3", &out)
+
+	var exitErr *ExitError
+	if assert.True(t, errors.As(err, &exitErr)) {
+		assert.Equal(t, 3, exitErr.Code)
+	}
+
+	// the script killed by a signal, e.g. by the OOM killer, is the failure of the script too.
+	err = s.Execute(context.Background(), "kill -9 $$", &out)
+	if assert.True(t, errors.As(err, &exitErr)) {
+		assert.Equal(t, 128+9, exitErr.Code)
+	}
+
+	out.Reset()
+	s.Environment([]string{"CI_JOB_NAME=test"})
+
+	err = s.Execute(context.Background(), "echo $CI_JOB_NAME", &out)
+	assert.NoError(t, err)
+	assert.Equal(t, "test\n", out.String())
+}
+
+func TestShellExecutor_Execute_timeout(t *testing.T) {
+	s := NewShellExecutor()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+
+	// the child process keeps stdout open, so the whole process group must be killed.
+	err := s.Execute(ctx, "sleep 30 & sleep 30; wait", ioutil.Discard)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
@@ -0,0 +1,289 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/ihippik/gitlab-runner/config"
+)
+
+const (
+	// defaultSSHPort port of the SSH server used when it is not configured.
+	defaultSSHPort = 22
+	// sshHandshakeTimeout limits the SSH handshake with the build machine.
+	sshHandshakeTimeout = 30 * time.Second
+	// sshCloseTimeout how long to wait for the remote command after its session was closed.
+	sshCloseTimeout = 5 * time.Second
+	// defaultSSHCleanupTimeout limits removal of the directories on the build machine when it is not configured.
+	defaultSSHCleanupTimeout = time.Minute
+)
+
+// SSHExecutor represent executor which runs scripts on the remote build machine over SSH.
+// The scripts are uploaded into the temporary directory of the build machine and executed
+// in the build directory of the same path as on the runner host, both are removed after the job.
+type SSHExecutor struct {
+	cfg config.SSHCfg
+
+	homeDir string
+	env     []string
+	client  *ssh.Client
+	tmpDir  string
+	scripts int
+}
+
+// NewSSHExecutor create new instance of ssh executor.
+func NewSSHExecutor(cfg config.SSHCfg) *SSHExecutor {
+	return &SSHExecutor{cfg: cfg}
+}
+
+// HomeDirectory set the build directory on the build machine.
+func (s *SSHExecutor) HomeDirectory(dir string) {
+	s.homeDir = dir
+}
+
+// Environment set job environment in KEY=VALUE form.
+func (s *SSHExecutor) Environment(env []string) {
+	s.env = env
+}
+
+// Prepare implements interface and connects to the build machine verifying its host key.
+func (s *SSHExecutor) Prepare(ctx context.Context, _ Options, output io.Writer) error {
+	port := s.cfg.Port
+	if port == 0 {
+		port = defaultSSHPort
+	}
+
+	address := net.JoinHostPort(s.cfg.Host, strconv.Itoa(port))
+	fmt.Fprintf(output, "Using SSH executor on %s...\n", address)
+
+	clientCfg, err := s.clientConfig()
+	if err != nil {
+		return err
+	}
+
+	client, err := dialSSH(ctx, address, clientCfg)
+	if err != nil {
+		return fmt.Errorf("connect to %s: %w", address, err)
+	}
+
+	s.client = client
+
+	// the build directory of the runner does not exist on the remote machine.
+	if s.homeDir != "" {
+		if err := s.run(ctx, "mkdir -p "+Quote(s.homeDir), nil, io.Discard, output); err != nil {
+			return fmt.Errorf("make build dir: %w", err)
+		}
+	}
+
+	var stdout bytes.Buffer
+
+	if err := s.run(ctx, "mktemp -d", nil, &stdout, output); err != nil {
+		return fmt.Errorf("make tmp dir: %w", err)
+	}
+
+	s.tmpDir = strings.TrimSpace(stdout.String())
+
+	return nil
+}
+
+// Execute implements interface, the script exports the job environment itself
+// since the SSH servers usually do not accept the environment of the client.
+// The remote command is killed and its session is closed when the context is done.
+// Non-zero exit status of the script is returned as *ExitError.
+func (s *SSHExecutor) Execute(ctx context.Context, script string, output io.Writer) error {
+	if s.client == nil {
+		return errors.New("not connected")
+	}
+
+	s.scripts++
+	path := fmt.Sprintf("%s/script-%d.sh", s.tmpDir, s.scripts)
+
+	upload := strings.NewReader(exportScript(s.env, s.homeDir, script))
+	if err := s.run(ctx, "cat > "+Quote(path), upload, io.Discard, output); err != nil {
+		return fmt.Errorf("upload script: %w", err)
+	}
+
+	// stdout and stderr are copied concurrently.
+	output = &lockedWriter{w: output}
+
+	return s.run(ctx, "bash --noprofile --norc "+Quote(path), nil, output, output)
+}
+
+// Cleanup implements interface, removes the build and temporary directories and closes the connection.
+func (s *SSHExecutor) Cleanup(ctx context.Context) error {
+	if s.client == nil {
+		return nil
+	}
+
+	defer func() {
+		s.client.Close()
+		s.client = nil
+	}()
+
+	timeout := s.cfg.CleanupTimeout
+	if timeout <= 0 {
+		timeout = defaultSSHCleanupTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	command := "rm -rf"
+	for _, dir := range []string{s.tmpDir, s.homeDir} {
+		if dir != "" {
+			command += " " + Quote(dir)
+		}
+	}
+
+	var stderr bytes.Buffer
+
+	if err := s.run(ctx, command, nil, io.Discard, &stderr); err != nil {
+		return fmt.Errorf("remove dirs: %w(%s)", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// clientConfig returns configuration of the SSH client with key or password authentication.
+func (s *SSHExecutor) clientConfig() (*ssh.ClientConfig, error) {
+	knownHostsFile := s.cfg.KnownHostsFile
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("home dir: %w", err)
+		}
+
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("known hosts: %w", err)
+	}
+
+	var auth ssh.AuthMethod
+
+	switch {
+	case s.cfg.IdentityFile != "":
+		key, err := os.ReadFile(s.cfg.IdentityFile)
+		if err != nil {
+			return nil, fmt.Errorf("read identity file: %w", err)
+		}
+
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("parse identity file: %w", err)
+		}
+
+		auth = ssh.PublicKeys(signer)
+	case s.cfg.Password != "":
+		auth = ssh.Password(s.cfg.Password)
+	default:
+		return nil, errors.New("neither identity file nor password is configured")
+	}
+
+	return &ssh.ClientConfig{
+		User:            s.cfg.User,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: hostKeyCallback,
+	}, nil
+}
+
+// dialSSH connects to the SSH server and performs the handshake.
+func dialSSH(ctx context.Context, address string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+	var dialer net.Dialer
+
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(sshHandshakeTimeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, address, cfg)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		sshConn.Close()
+		return nil, err
+	}
+
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// run runs the command in a new session of the connection until it exits or the context is done.
+func (s *SSHExecutor) run(ctx context.Context, command string, stdin io.Reader, stdout, stderr io.Writer) error {
+	session, err := s.client.NewSession()
+	if err != nil {
+		return fmt.Errorf("new session: %w", err)
+	}
+	defer session.Close()
+
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	if err := session.Start(command); err != nil {
+		return fmt.Errorf("start: %w", err)
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- session.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		var exitErr *ssh.ExitError
+		if errors.As(err, &exitErr) {
+			return &ExitError{Code: exitErr.ExitStatus()}
+		}
+
+		return err
+	case <-ctx.Done():
+		// the signals are not supported by all the servers, closing of the session hangs up the command.
+		_ = session.Signal(ssh.SIGKILL)
+		session.Close()
+
+		select {
+		case <-done:
+		case <-time.After(sshCloseTimeout):
+		}
+
+		return ctx.Err()
+	}
+}
+
+// lockedWriter serializes writes into the underlying writer.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Write implements io.Writer.
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.w.Write(p)
+}
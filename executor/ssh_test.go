@@ -0,0 +1,292 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/ihippik/gitlab-runner/config"
+)
+
+// sshServer in-process SSH server which executes the commands on the local machine.
+type sshServer struct {
+	address  string
+	hostKey  ssh.PublicKey
+	userKey  ed25519.PrivateKey
+	password string
+}
+
+// newSSHServer starts SSH server accepting the password or the user key.
+func newSSHServer(t *testing.T) *sshServer {
+	t.Helper()
+
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not installed")
+	}
+
+	_, hostPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostSigner, err := ssh.NewSignerFromKey(hostPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, userPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userSigner, err := ssh.NewSignerFromKey(userPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &sshServer{hostKey: hostSigner.PublicKey(), userKey: userPrivate, password: "secret"}
+
+	cfg := &ssh.ServerConfig{
+		PasswordCallback: func(_ ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != srv.password {
+				return nil, errors.New("wrong password")
+			}
+
+			return nil, nil
+		},
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), userSigner.PublicKey().Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+
+			return nil, nil
+		},
+	}
+	cfg.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	srv.address = listener.Addr().String()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go srv.serve(conn, cfg)
+		}
+	}()
+
+	return srv
+}
+
+// serve handles the SSH connection, only exec requests of the sessions are supported.
+func (s *sshServer) serve(conn net.Conn, cfg *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+
+		go s.session(channel, requests)
+	}
+}
+
+// session runs the command of the exec request by bash and reports its exit status.
+func (s *sshServer) session(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	for req := range requests {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+
+		// the payload is the command prefixed by its length.
+		command := string(req.Payload[4:])
+		req.Reply(true, nil)
+
+		cmd := exec.Command("bash", "-c", command)
+		cmd.Stdin = channel
+		cmd.Stdout = channel
+		cmd.Stderr = channel.Stderr()
+
+		code := 0
+
+		var exitErr *exec.ExitError
+		if err := cmd.Run(); errors.As(err, &exitErr) {
+			code = exitErr.ExitCode()
+		} else if err != nil {
+			code = 255
+		}
+
+		status := make([]byte, 4)
+		binary.BigEndian.PutUint32(status, uint32(code))
+		channel.SendRequest("exit-status", false, status)
+
+		return
+	}
+}
+
+// knownHosts writes known_hosts file with the key of the server.
+func (s *sshServer) knownHosts(t *testing.T, key ssh.PublicKey) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(path, []byte(knownhosts.Line([]string{s.address}, key)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// sshConfig returns config of the executor connecting to the server.
+func (s *sshServer) sshConfig(t *testing.T) config.SSHCfg {
+	t.Helper()
+
+	host, port, _ := net.SplitHostPort(s.address)
+	portNumber, _ := strconv.Atoi(port)
+
+	return config.SSHCfg{
+		Host:           host,
+		Port:           portNumber,
+		User:           "runner",
+		KnownHostsFile: s.knownHosts(t, s.hostKey),
+	}
+}
+
+func TestSSHExecutor(t *testing.T) {
+	srv := newSSHServer(t)
+
+	// the unencrypted private key of the user in OpenSSH format.
+	block, err := ssh.MarshalPrivateKey(srv.userKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identityFile := filepath.Join(t.TempDir(), "id_ed25519")
+	assert.NoError(t, os.WriteFile(identityFile, pem.EncodeToMemory(block), 0o600))
+
+	cfg := srv.sshConfig(t)
+	cfg.IdentityFile = identityFile
+
+	homeDir := filepath.Join(t.TempDir(), "builds", "project")
+
+	s := NewSSHExecutor(cfg)
+	s.HomeDirectory(homeDir)
+	s.Environment([]string{"CI_JOB_NAME=test", "QUOTED=it's"})
+
+	var out bytes.Buffer
+
+	assert.NoError(t, s.Prepare(context.Background(), Options{}, &out))
+	assert.Contains(t, out.String(), "Using SSH executor on "+srv.address)
+
+	out.Reset()
+
+	// stdout and stderr are separate channels, so the order of their lines is not defined.
+	assert.NoError(t, s.Execute(context.Background(), "echo $CI_JOB_NAME $QUOTED; pwd >&2", &out))
+	assert.Contains(t, out.String(), "test it's\n")
+	assert.Contains(t, out.String(), homeDir+"\n")
+
+	err = s.Execute(context.Background(), "exit 3", &out)
+
+	var exitErr *ExitError
+	if assert.True(t, errors.As(err, &exitErr)) {
+		assert.Equal(t, 3, exitErr.Code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	err = s.Execute(ctx, "sleep 30", &out)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	tmpDir := s.tmpDir
+	assert.DirExists(t, tmpDir)
+
+	// the build and the temporary directories are removed.
+	assert.NoError(t, s.Cleanup(context.Background()))
+	assertNotExist(t, homeDir)
+	assertNotExist(t, tmpDir)
+}
+
+func TestSSHExecutor_Prepare(t *testing.T) {
+	srv := newSSHServer(t)
+
+	// password authentication.
+	cfg := srv.sshConfig(t)
+	cfg.Password = srv.password
+
+	s := NewSSHExecutor(cfg)
+	assert.NoError(t, s.Prepare(context.Background(), Options{}, &bytes.Buffer{}))
+	assert.NoError(t, s.Cleanup(context.Background()))
+
+	// wrong password.
+	cfg.Password = "wrong"
+	assert.Error(t, NewSSHExecutor(cfg).Prepare(context.Background(), Options{}, &bytes.Buffer{}))
+
+	// the host key does not match the known one.
+	_, otherPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherKey, err := ssh.NewSignerFromKey(otherPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Password = srv.password
+	cfg.KnownHostsFile = srv.knownHosts(t, otherKey.PublicKey())
+
+	err = NewSSHExecutor(cfg).Prepare(context.Background(), Options{}, &bytes.Buffer{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "key mismatch")
+	}
+
+	// no credentials.
+	cfg.Password = ""
+	assert.Error(t, NewSSHExecutor(cfg).Prepare(context.Background(), Options{}, &bytes.Buffer{}))
+}
+
+// assertNotExist asserts that the file does not exist.
+func assertNotExist(t *testing.T, path string) {
+	t.Helper()
+
+	_, err := os.Stat(path)
+	assert.True(t, os.IsNotExist(err), path)
+}
@@ -0,0 +1,20 @@
+package executor
+
+import "context"
+
+// StageGetSources name of the job stage which fetches the sources of the project.
+const StageGetSources = "get_sources"
+
+// stageKey context key of the job stage to which the executed script belongs.
+type stageKey struct{}
+
+// WithStage returns copy of the context which carries the name of the job stage, e.g. "get_sources".
+func WithStage(ctx context.Context, stage string) context.Context {
+	return context.WithValue(ctx, stageKey{}, stage)
+}
+
+// Stage returns name of the job stage carried by the context, empty if it is unknown.
+func Stage(ctx context.Context) string {
+	stage, _ := ctx.Value(stageKey{}).(string)
+	return stage
+}
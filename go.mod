@@ -1,11 +1,22 @@
 module github.com/ihippik/gitlab-runner
 
-go 1.16
+go 1.17
 
 require (
+	github.com/bmatcuk/doublestar/v4 v4.0.2
 	github.com/sirupsen/logrus v1.8.1
-	github.com/stretchr/objx v0.1.1 // indirect
 	github.com/stretchr/testify v1.2.2
 	github.com/urfave/cli/v2 v2.3.0
+	golang.org/x/crypto v0.14.0
+	golang.org/x/sys v0.13.0
 	gopkg.in/yaml.v2 v2.2.3
 )
+
+require (
+	github.com/cpuguy83/go-md2man/v2 v2.0.0-20190314233015-f79a8a8ca69d // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/russross/blackfriday/v2 v2.0.1 // indirect
+	github.com/shurcooL/sanitized_anchor_name v1.0.0 // indirect
+	github.com/stretchr/objx v0.1.1 // indirect
+)
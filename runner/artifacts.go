@@ -0,0 +1,233 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/ihippik/gitlab-runner/artifacts"
+)
+
+// defaultArtifactName name of the archive used when the job does not define it.
+const defaultArtifactName = "artifacts"
+
+// types of the artifacts reports which are validated before upload.
+const (
+	artifactTypeJUnit  = "junit"
+	artifactTypeDotenv = "dotenv"
+)
+
+// shouldUpload reports whether the artifact must be uploaded according to its condition,
+// artifacts without condition are uploaded only if the job succeeded.
+func (a artifact) shouldUpload(failed bool) bool {
+	return whenMatches(a.When, failed)
+}
+
+// upload archives and uploads job artifacts to the Gitlab, one archive per artifact.
+func (b *Build) upload(ctx context.Context, failed bool) error {
+	b.setState(buildStateUploading)
+	defer b.setState(buildStateRunning)
+
+	for i, item := range b.job.Artifacts {
+		if !item.shouldUpload(failed) {
+			continue
+		}
+
+		if err := b.uploadArtifact(ctx, i, item); err != nil {
+			return fmt.Errorf("artifact %s: %w", artifactName(item), err)
+		}
+	}
+
+	return nil
+}
+
+// uploadArtifact collects files of the artifact, packs them into the archive and uploads it.
+func (b *Build) uploadArtifact(ctx context.Context, index int, item artifact) error {
+	name := artifactName(item)
+
+	files, err := artifacts.Collect(ctx, b.buildDir, artifacts.Options{
+		Paths:     item.Paths,
+		Exclude:   item.Exclude,
+		Untracked: item.Untracked,
+	})
+	if err != nil {
+		return fmt.Errorf("collect: %w", err)
+	}
+
+	if len(files) == 0 {
+		b.trace(fmt.Sprintf("%sWARNING: no files to upload for %s%s\n", ansiBoldYellow, name, ansiReset))
+		return nil
+	}
+
+	format := artifacts.Format(item.Format)
+
+	switch item.Type {
+	case artifactTypeJUnit:
+		files = b.validReports(files, artifacts.ValidateJUnit)
+	case artifactTypeDotenv:
+		files = b.validReports(files, func(r io.Reader) error {
+			_, err := artifacts.ParseDotenv(r)
+			return err
+		})
+	}
+
+	if len(files) == 0 {
+		return nil
+	}
+
+	if format == "" {
+		format = artifacts.FormatZip
+
+		// Gitlab accepts the reports only as gzip.
+		if item.Type == artifactTypeJUnit || item.Type == artifactTypeDotenv {
+			format = artifacts.FormatGzip
+		}
+	}
+
+	// every archive has its own directory, so the uploaded file name is the artifact name.
+	dir := filepath.Join(b.tmpDir(), "artifacts-"+strconv.Itoa(index))
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("make archive dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, name+format.Extension())
+
+	if err := writeArchive(path, b.buildDir, files, format); err != nil {
+		return err
+	}
+
+	b.trace(fmt.Sprintf("%sUploading artifacts%s: %s (%d files)\n", ansiBoldYellow, ansiReset, name, len(files)))
+
+	options := item.artifactsOptions
+	options.Format = artifactFormat(format)
+
+	return b.gitlab.uploadArtifacts(ctx, b.job.ID, b.job.Token, path, options, b.uploadProgress(name))
+}
+
+// validReports returns the report files which pass the validation, invalid ones are reported in the trace.
+func (b *Build) validReports(files []string, validate func(r io.Reader) error) []string {
+	valid := make([]string, 0, len(files))
+
+	for _, file := range files {
+		err := validateFile(filepath.Join(b.buildDir, filepath.FromSlash(file)), validate)
+		if err != nil {
+			b.trace(fmt.Sprintf("%sWARNING: invalid report %s: %s%s\n", ansiBoldYellow, file, err, ansiReset))
+			continue
+		}
+
+		valid = append(valid, file)
+	}
+
+	return valid
+}
+
+// validateFile validates content of the file.
+func validateFile(path string, validate func(r io.Reader) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return validate(file)
+}
+
+// writeArchive creates archive file of the specified format.
+func writeArchive(path, dir string, files []string, format artifacts.Format) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create archive: %w", err)
+	}
+
+	if err := artifacts.Archive(file, dir, files, format); err != nil {
+		file.Close()
+		return fmt.Errorf("archive: %w", err)
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("close archive: %w", err)
+	}
+
+	return nil
+}
+
+// artifactName returns name of the artifact archive without extension.
+func artifactName(item artifact) string {
+	name := filepath.Base(filepath.Clean("/" + item.Name))
+	if name == "/" || name == "." {
+		return defaultArtifactName
+	}
+
+	return name
+}
+
+// downloadDependencies downloads artifacts of the dependency jobs and extracts them into the build directory.
+func (b *Build) downloadDependencies(ctx context.Context) error {
+	for _, dep := range b.job.Dependencies {
+		if dep.ArtifactsFile.Filename == "" {
+			continue
+		}
+
+		b.trace(fmt.Sprintf("Downloading artifacts for %s (%d)...\n", dep.Name, dep.ID))
+
+		if err := b.downloadDependency(ctx, dep); err != nil {
+			return fmt.Errorf("%s (%d): %w", dep.Name, dep.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// downloadDependency downloads artifacts archive of the dependency into the temporary file and extracts it.
+func (b *Build) downloadDependency(ctx context.Context, dep dependency) error {
+	file, err := os.CreateTemp(b.tmpDir(), "dependency-*.zip")
+	if err != nil {
+		return fmt.Errorf("create archive: %w", err)
+	}
+
+	defer func() {
+		file.Close()
+		os.Remove(file.Name())
+	}()
+
+	if err := b.gitlab.downloadArtifacts(ctx, dep.ID, dep.Token, file); err != nil {
+		return fmt.Errorf("download: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("stat archive: %w", err)
+	}
+
+	if err := artifacts.Extract(file, info.Size(), b.buildDir); err != nil {
+		return fmt.Errorf("extract: %w", err)
+	}
+
+	return nil
+}
+
+// uploadProgress returns function which traces the upload progress of the file
+// every time the next quarter of the file is uploaded.
+func (b *Build) uploadProgress(name string) func(uploaded, total int64) {
+	const steps = 4
+
+	var reported int64
+
+	return func(uploaded, total int64) {
+		if total <= 0 {
+			return
+		}
+
+		step := uploaded * steps / total
+		if step <= reported {
+			return
+		}
+
+		reported = step
+		b.trace(fmt.Sprintf("Uploading %s: %d%% (%d of %d bytes)\n", name, step*100/steps, uploaded, total))
+	}
+}
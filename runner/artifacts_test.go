@@ -0,0 +1,249 @@
+package runner
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ihippik/gitlab-runner/artifacts"
+	"github.com/ihippik/gitlab-runner/config"
+)
+
+// gitlabUploadFake stores names of the files of the uploaded zip archives.
+type gitlabUploadFake struct {
+	gitlabTraceFake
+
+	uploads map[string][]string
+}
+
+func (g *gitlabUploadFake) uploadArtifacts(
+	_ context.Context,
+	_ int,
+	_, path string,
+	options artifactsOptions,
+	_ func(uploaded, total int64),
+) error {
+	var names []string
+
+	if options.Format == artifactFormat(artifacts.FormatGzip) {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		r := bufio.NewReader(file)
+
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+
+		for {
+			gz.Multistream(false)
+
+			if _, err := io.Copy(ioutil.Discard, gz); err != nil {
+				return err
+			}
+
+			names = append(names, gz.Name)
+
+			if err := gz.Reset(r); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+		}
+	} else {
+		archive, err := zip.OpenReader(path)
+		if err != nil {
+			return err
+		}
+		defer archive.Close()
+
+		for _, file := range archive.File {
+			names = append(names, file.Name)
+		}
+	}
+
+	sort.Strings(names)
+	g.uploads[filepath.Base(path)+":"+options.Type+":"+string(options.Format)] = names
+
+	return nil
+}
+
+// gitlabDownloadFake serves zip archives of the dependency jobs.
+type gitlabDownloadFake struct {
+	gitlabTraceFake
+
+	archives map[int][]byte
+	tokens   map[int]string
+}
+
+func (g *gitlabDownloadFake) downloadArtifacts(_ context.Context, id int, token string, w io.Writer) error {
+	if g.tokens[id] != token {
+		return assert.AnError
+	}
+
+	archive, ok := g.archives[id]
+	if !ok {
+		return errArtifactsNotFound
+	}
+
+	_, err := w.Write(archive)
+
+	return err
+}
+
+func TestBuild_downloadDependencies(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+
+	src := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(src, "bin"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(src, "bin", "app"), []byte("binary"), 0o755))
+
+	var archive bytes.Buffer
+	assert.NoError(t, artifacts.Archive(&archive, src, []string{"bin/app"}, artifacts.FormatZip))
+
+	gitlab := &gitlabDownloadFake{
+		gitlabTraceFake: gitlabTraceFake{state: remoteJobStateRunning, traces: make(map[int][]byte)},
+		archives:        map[int][]byte{1: archive.Bytes()},
+		tokens:          map[int]string{1: "build-token", 2: "lint-token"},
+	}
+
+	job := &jobResponse{
+		ID: 3,
+		Dependencies: []dependency{
+			{ID: 1, Token: "build-token", Name: "build", ArtifactsFile: dependencyArtifactsFile{Filename: "artifacts.zip"}},
+			{ID: 2, Token: "lint-token", Name: "lint"},
+		},
+	}
+
+	build := newBuild(logrus.NewEntry(logger), &config.RunnerCfg{}, gitlab, nil, job, t.TempDir(), 0)
+	build.tracer = newTraceWriter(context.Background(), gitlab, job, 0, 0, func() {})
+	build.output = newMaskWriter(build.tracer, nil, false)
+
+	assert.NoError(t, os.MkdirAll(build.tmpDir(), 0o700))
+	assert.NoError(t, build.downloadDependencies(context.Background()))
+	assert.NoError(t, build.tracer.Close())
+
+	content, err := os.ReadFile(filepath.Join(build.buildDir, "bin", "app"))
+	assert.NoError(t, err)
+	assert.Equal(t, "binary", string(content))
+
+	trace := string(gitlab.traces[3])
+	assert.Contains(t, trace, "Downloading artifacts for build (1)...")
+	assert.NotContains(t, trace, "lint")
+
+	// artifacts of the dependency were expired.
+	job.Dependencies[1].ArtifactsFile.Filename = "artifacts.zip"
+	assert.True(t, errors.Is(build.downloadDependencies(context.Background()), errArtifactsNotFound))
+}
+
+func TestBuild_upload(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+
+	job := &jobResponse{
+		ID: 1,
+		Artifacts: []artifact{
+			{Paths: []string{"build/"}, Exclude: []string{"build/*.log"}},
+			{Paths: []string{"reports/*.xml"}, When: stepWhenOnFailure, artifactsOptions: artifactsOptions{Name: "reports"}},
+			{Paths: []string{"coverage.out"}, When: stepWhenAlways, artifactsOptions: artifactsOptions{Name: "coverage"}},
+			{Paths: []string{"missing/*"}, When: stepWhenAlways, artifactsOptions: artifactsOptions{Name: "missing"}},
+		},
+	}
+
+	newFake := func() *gitlabUploadFake {
+		return &gitlabUploadFake{
+			gitlabTraceFake: gitlabTraceFake{state: remoteJobStateRunning, traces: make(map[int][]byte)},
+			uploads:         make(map[string][]string),
+		}
+	}
+
+	gitlab := newFake()
+	build := newBuild(logrus.NewEntry(logger), &config.RunnerCfg{}, gitlab, nil, job, t.TempDir(), 0)
+	build.tracer = newTraceWriter(context.Background(), gitlab, job, 0, 0, func() {})
+	build.output = newMaskWriter(build.tracer, nil, false)
+
+	for _, file := range []string{"build/app", "build/make.log", "build/lib/app.so", "reports/unit.xml", "coverage.out"} {
+		path := filepath.Join(build.buildDir, file)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		assert.NoError(t, os.WriteFile(path, []byte(file), 0o644))
+	}
+
+	assert.NoError(t, build.upload(context.Background(), false))
+	assert.Equal(t, map[string][]string{
+		"artifacts.zip::zip": {"build/app", "build/lib/app.so"},
+		"coverage.zip::zip":  {"coverage.out"},
+	}, gitlab.uploads)
+
+	assert.NoError(t, build.tracer.Close())
+	assert.Contains(t, string(gitlab.traces[1]), "WARNING: no files to upload for missing")
+
+	gitlab = newFake()
+	build.gitlab = gitlab
+
+	assert.NoError(t, build.upload(context.Background(), true))
+	assert.Equal(t, map[string][]string{
+		"reports.zip::zip":  {"reports/unit.xml"},
+		"coverage.zip::zip": {"coverage.out"},
+	}, gitlab.uploads)
+}
+
+func TestBuild_upload_reports(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+
+	job := &jobResponse{
+		ID: 1,
+		Artifacts: []artifact{
+			{Paths: []string{"reports/*.xml"}, artifactsOptions: artifactsOptions{Name: "junit.xml", Type: artifactTypeJUnit}},
+			{Paths: []string{"build.env"}, artifactsOptions: artifactsOptions{Name: "dotenv", Type: artifactTypeDotenv}},
+			{Paths: []string{"invalid.env"}, artifactsOptions: artifactsOptions{Name: "invalid", Type: artifactTypeDotenv}},
+		},
+	}
+
+	gitlab := &gitlabUploadFake{
+		gitlabTraceFake: gitlabTraceFake{state: remoteJobStateRunning, traces: make(map[int][]byte)},
+		uploads:         make(map[string][]string),
+	}
+
+	build := newBuild(logrus.NewEntry(logger), &config.RunnerCfg{}, gitlab, nil, job, t.TempDir(), 0)
+	build.tracer = newTraceWriter(context.Background(), gitlab, job, 0, 0, func() {})
+	build.output = newMaskWriter(build.tracer, nil, false)
+
+	for file, content := range map[string]string{
+		"reports/unit.xml":   `<testsuites><testsuite name="unit"/></testsuites>`,
+		"reports/broken.xml": `<testsuites>`,
+		"build.env":          "VERSION=1.2.3\n",
+		"invalid.env":        "not a variable\n",
+	} {
+		path := filepath.Join(build.buildDir, file)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	}
+
+	assert.NoError(t, build.upload(context.Background(), false))
+	assert.Equal(t, map[string][]string{
+		"junit.xml.gz:junit:gzip": {"reports/unit.xml"},
+		"dotenv.gz:dotenv:gzip":   {"build.env"},
+	}, gitlab.uploads)
+
+	assert.NoError(t, build.tracer.Close())
+
+	trace := string(gitlab.traces[1])
+	assert.Contains(t, trace, "WARNING: invalid report reports/broken.xml")
+	assert.Contains(t, trace, "WARNING: invalid report invalid.env")
+}
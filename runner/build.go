@@ -0,0 +1,776 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/ihippik/gitlab-runner/cache"
+	"github.com/ihippik/gitlab-runner/config"
+	"github.com/ihippik/gitlab-runner/executor"
+)
+
+// buildState represent state of the build.
+type buildState string
+
+// available build states.
+const (
+	buildStatePending   buildState = "pending"
+	buildStatePreparing buildState = "preparing"
+	buildStateRunning   buildState = "running"
+	buildStateUploading buildState = "uploading"
+	buildStateSuccess   buildState = "success"
+	buildStateFailed    buildState = "failed"
+	buildStateCanceled  buildState = "canceled"
+)
+
+const (
+	// defaultJobTimeout used when the Gitlab did not send the job timeout.
+	defaultJobTimeout = time.Hour
+	// defaultAfterScriptTimeout used when the Gitlab did not send the after_script step timeout.
+	defaultAfterScriptTimeout = 5 * time.Minute
+	// defaultStatusInterval interval between job status checks.
+	defaultStatusInterval = 3 * time.Second
+	// stepNameAfterScript name of the step which is executed after all other steps, whatever their result.
+	stepNameAfterScript = "after_script"
+)
+
+// names of the job stages passed to the executor along with the scripts.
+const (
+	stageGetSources  = executor.StageGetSources
+	stageStepPrefix  = "step_"
+	stageAfterScript = "after_script"
+)
+
+// Build represent a single job processed by the gitlab-runner.
+type Build struct {
+	logger *logrus.Entry
+	config *config.RunnerCfg
+
+	gitlab   gitlabAPI
+	executor Executor
+	job      *jobResponse
+
+	concurrentID   int
+	statusInterval time.Duration
+	buildsDir      string
+	buildDir       string
+	tracer         *traceWriter
+	output         *maskWriter
+	coverage       *coverageScanner
+	cacheBackend   cache.Backend
+
+	mu       sync.Mutex
+	state    buildState
+	cancel   context.CancelFunc
+	canceled bool
+}
+
+// newBuild create new Build instance for the received job.
+func newBuild(
+	logger *logrus.Entry,
+	cfg *config.RunnerCfg,
+	gitlab gitlabAPI,
+	executor Executor,
+	job *jobResponse,
+	buildsDir string,
+	concurrentID int,
+) *Build {
+	return &Build{
+		logger:       logger.WithField("job_id", job.ID),
+		config:       cfg,
+		gitlab:       gitlab,
+		executor:     executor,
+		job:          job,
+		concurrentID: concurrentID,
+		buildsDir:    buildsDir,
+		buildDir: filepath.Join(
+			buildsDir,
+			shortToken(cfg.Token),
+			strconv.Itoa(concurrentID),
+			projectPath(job),
+		),
+		state: buildStatePending,
+
+		statusInterval: defaultStatusInterval,
+	}
+}
+
+// projectPath returns namespace and name of the job project in "namespace/project" form.
+func projectPath(job *jobResponse) string {
+	path, ok := job.Variables.Get("CI_PROJECT_PATH")
+	if !ok {
+		if repoURL, err := url.Parse(job.GitInfo.RepoURL); err == nil {
+			path = strings.TrimSuffix(repoURL.Path, ".git")
+		}
+	}
+
+	path = filepath.Clean("/" + path)
+	if path == "/" {
+		return fmt.Sprintf("project-%d", job.ID)
+	}
+
+	return strings.TrimPrefix(path, "/")
+}
+
+// State returns current build state.
+func (b *Build) State() buildState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
+
+// setState changes build state.
+func (b *Build) setState(state buildState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.logger.WithFields(logrus.Fields{"from": b.state, "to": state}).Debugln("build state changed")
+	b.state = state
+}
+
+// TraceOffset returns current offset of the job trace.
+func (b *Build) TraceOffset() int {
+	if b.tracer == nil {
+		return 0
+	}
+
+	return b.tracer.Offset()
+}
+
+// Run processes the job and reports its result to the Gitlab.
+func (b *Build) Run(ctx context.Context) error {
+	timeout := b.timeout()
+
+	jobCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	b.cancel = cancel
+	defer b.cleanup()
+	defer b.cleanupExecutor()
+
+	b.tracer = newTraceWriter(
+		ctx,
+		b.gitlab,
+		b.job,
+		b.config.TraceFlushInterval,
+		b.config.TraceFlushSize,
+		b.markCanceled,
+	)
+	b.tracer.Start()
+	var output io.Writer = b.tracer
+
+	if b.job.CoverageRegex != "" {
+		coverage, err := newCoverageScanner(b.job.CoverageRegex)
+		if err != nil {
+			b.logger.WithError(err).Warnln("coverage is not reported")
+		} else {
+			b.coverage = coverage
+			output = io.MultiWriter(b.tracer, coverage)
+		}
+	}
+
+	b.output = newMaskWriter(output, b.job.Variables.masked(), b.config.MaskEncoded)
+
+	defer func() {
+		if err := b.output.Flush(); err != nil {
+			b.logger.WithError(err).Errorln("job trace error")
+		}
+
+		if err := b.tracer.Close(); err != nil {
+			b.logger.WithError(err).Errorln("job trace error")
+		}
+	}()
+
+	helloStr := fmt.Sprintf("Runner %s%s%s greets you!\n", ansiBoldBlue, b.config.Name, ansiReset)
+	b.trace(helloStr)
+	b.trace("I'm getting started.\n")
+
+	watchCtx, stopWatch := context.WithCancel(jobCtx)
+	defer stopWatch()
+
+	watchDone := make(chan struct{})
+
+	go func() {
+		defer close(watchDone)
+		b.watch(watchCtx)
+	}()
+
+	err := b.process(jobCtx)
+
+	// after_script, cache saving and artifacts upload run only if the scripts were started
+	// and are not limited by the job timeout.
+	if b.State() == buildStateRunning {
+		b.afterScript(ctx)
+
+		if !b.isCanceled() {
+			b.saveCache(ctx, err != nil)
+
+			if uploadErr := b.upload(ctx, err != nil); uploadErr != nil {
+				b.logger.WithError(uploadErr).Errorln("upload artefacts error")
+
+				if err == nil {
+					err = systemFailure(ctx, fmt.Errorf("upload artefact: %w", uploadErr))
+				}
+			}
+		}
+	}
+
+	// the keepalive must not reach the Gitlab after the final state of the job.
+	stopWatch()
+	<-watchDone
+
+	if b.isCanceled() {
+		b.setState(buildStateCanceled)
+		b.logger.Warnln("job was canceled")
+
+		return nil
+	}
+
+	if err != nil {
+		b.setState(buildStateFailed)
+
+		reason := jobFailureReason(jobCtx, err)
+		if reason == failureReasonJobExecution {
+			b.trace(fmt.Sprintf("%sERROR: execution took longer than %s%s\n", ansiBoldRed, timeout, ansiReset))
+		}
+
+		if err := b.jobFailed(ctx, reason, exitCode(err), err.Error()); err != nil {
+			return fmt.Errorf("process: job failed: %w", err)
+		}
+
+		return fmt.Errorf("job process: %w", err)
+	}
+
+	b.setState(buildStateSuccess)
+
+	if err := b.jobFinished(ctx); err != nil {
+		return fmt.Errorf("job finished: %w", err)
+	}
+
+	return nil
+}
+
+// markCanceled marks the build as canceled by the Gitlab and stops the job execution.
+func (b *Build) markCanceled() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.canceled = true
+	b.cancel()
+}
+
+// isCanceled reports whether the build was canceled by the Gitlab.
+func (b *Build) isCanceled() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.canceled
+}
+
+// watch periodically checks the remote job state until the job context is done.
+func (b *Build) watch(ctx context.Context) {
+	ticker := time.NewTicker(b.statusInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			state, err := b.gitlab.updateJob(
+				ctx,
+				b.job.ID,
+				&updateJobRequest{Token: b.job.Token, State: string(remoteJobStateRunning)},
+			)
+			if err != nil {
+				b.logger.WithError(err).Debugln("check job status")
+			}
+
+			if state.isCanceled() {
+				b.markCanceled()
+				return
+			}
+		}
+	}
+}
+
+// afterScript runs after_script steps within their own timeout,
+// failures of the after_script do not affect the job result.
+func (b *Build) afterScript(ctx context.Context) {
+	for _, step := range b.job.Steps {
+		if step.Name != stepNameAfterScript {
+			continue
+		}
+
+		if step.Timeout <= 0 {
+			step.Timeout = int(defaultAfterScriptTimeout.Seconds())
+		}
+
+		b.trace("Running after_script\n")
+
+		if err := b.executeStep(ctx, step); err != nil {
+			b.logger.WithError(err).Warnln("after script error")
+			b.trace(fmt.Sprintf(
+				"%sWARNING: after_script failed, but job will continue unaffected: %s%s\n",
+				ansiBoldYellow,
+				err,
+				ansiReset,
+			))
+		}
+	}
+}
+
+// timeout returns the job timeout limited by the runner maximum timeout.
+func (b *Build) timeout() time.Duration {
+	timeout := time.Duration(b.job.RunnerInfo.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultJobTimeout
+	}
+
+	if maxTimeout := b.config.MaximumTimeout; maxTimeout > 0 && maxTimeout < timeout {
+		timeout = maxTimeout
+	}
+
+	return timeout
+}
+
+// trace add job trace.
+func (b *Build) trace(message string) {
+	if _, err := b.output.Write([]byte(message)); err != nil {
+		b.logger.WithError(err).Errorln("job trace error")
+	}
+}
+
+// flushTrace sends the buffered job trace to the Gitlab.
+func (b *Build) flushTrace() {
+	if err := b.output.Flush(); err != nil {
+		b.logger.WithError(err).Errorln("job trace error")
+	}
+
+	if err := b.tracer.Flush(); err != nil {
+		b.logger.WithError(err).Errorln("job trace error")
+	}
+}
+
+// jobFinished set job success state.
+func (b *Build) jobFinished(ctx context.Context) error {
+	succeeded := fmt.Sprintf("%sJob succeeded!%s", ansiBoldGreen, ansiReset)
+	b.trace(succeeded)
+	b.flushTrace()
+
+	if _, err := b.gitlab.updateJob(
+		ctx,
+		b.job.ID,
+		&updateJobRequest{
+			Token:    b.job.Token,
+			State:    "success",
+			ExitCode: 0,
+			Coverage: b.coverageValue(),
+		},
+	); err != nil {
+		return err
+	}
+
+	b.logger.Infoln("job was finished")
+
+	return nil
+}
+
+// jobFailed set job failed state, zero exit code is not sent to the Gitlab.
+func (b *Build) jobFailed(ctx context.Context, reason failureReason, exitCode int, desc string) error {
+	msg := fmt.Sprintf("%sjob failed: %s%s", ansiBoldRed, desc, ansiReset)
+	b.trace(msg)
+	b.flushTrace()
+
+	if _, err := b.gitlab.updateJob(
+		ctx,
+		b.job.ID,
+		&updateJobRequest{
+			Token:         b.job.Token,
+			State:         "failed",
+			FailureReason: reason,
+			ExitCode:      exitCode,
+			Coverage:      b.coverageValue(),
+		},
+	); err != nil {
+		return err
+	}
+
+	b.logger.WithFields(logrus.Fields{"reason": reason, "exit_code": exitCode}).Warnln("job failed")
+
+	return nil
+}
+
+// coverageValue returns the test coverage found in the job trace, nil if it was not found.
+func (b *Build) coverageValue() *float64 {
+	if b.coverage == nil {
+		return nil
+	}
+
+	return b.coverage.Value()
+}
+
+// variables returns predefined variables followed by the job variables, all of them expanded.
+func (b *Build) variables() jobVariables {
+	predefined := jobVariables{
+		{Key: "CI", Value: "true", Public: true},
+		{Key: "GITLAB_CI", Value: "true", Public: true},
+		{Key: "CI_SERVER", Value: "yes", Public: true},
+		{Key: "CI_BUILDS_DIR", Value: b.buildsDir, Public: true},
+		{Key: "CI_PROJECT_DIR", Value: b.buildDir, Public: true},
+		{Key: "CI_CONCURRENT_ID", Value: strconv.Itoa(b.concurrentID), Public: true},
+		{Key: "CI_CONCURRENT_PROJECT_ID", Value: strconv.Itoa(b.concurrentID), Public: true},
+		{Key: "CI_RUNNER_DESCRIPTION", Value: b.config.Name, Public: true},
+		{Key: "CI_RUNNER_TAGS", Value: strings.Join(b.config.Tags, ", "), Public: true},
+		{Key: "CI_RUNNER_SHORT_TOKEN", Value: shortToken(b.config.Token), Public: true},
+		{Key: "CI_RUNNER_EXECUTABLE_ARCH", Value: runtime.GOOS + "/" + runtime.GOARCH, Public: true},
+	}
+
+	variables := append(predefined, b.job.Variables...)
+
+	for i := range variables {
+		if variables[i].File {
+			variables[i].Value = b.fileVariablePath(variables[i].Key)
+		}
+	}
+
+	return variables.Expand()
+}
+
+// tmpDir returns per-build temporary directory which lives next to the build directory.
+func (b *Build) tmpDir() string {
+	return b.buildDir + ".tmp"
+}
+
+// fileVariablePath returns path of the file in which file variable value is stored.
+func (b *Build) fileVariablePath(key string) string {
+	return filepath.Join(b.tmpDir(), key)
+}
+
+// writeFileVariables stores values of the file variables in the build temporary directory.
+func (b *Build) writeFileVariables() error {
+	if err := os.MkdirAll(b.tmpDir(), 0o700); err != nil {
+		return fmt.Errorf("make tmp dir: %w", err)
+	}
+
+	for _, variable := range b.job.Variables {
+		if !variable.File {
+			continue
+		}
+
+		if err := os.WriteFile(b.fileVariablePath(variable.Key), []byte(variable.Value), 0o600); err != nil {
+			return fmt.Errorf("write file variable %s: %w", variable.Key, err)
+		}
+	}
+
+	return nil
+}
+
+// cleanup removes the build temporary directory.
+func (b *Build) cleanup() {
+	if b.buildDir == "" {
+		return
+	}
+
+	if err := os.RemoveAll(b.tmpDir()); err != nil {
+		b.logger.WithError(err).Warnln("remove tmp dir")
+	}
+}
+
+// cleanupExecutor removes everything the executor has created for the job, the executor limits the cleanup itself.
+func (b *Build) cleanupExecutor() {
+	if err := b.executor.Cleanup(context.Background()); err != nil {
+		b.logger.WithError(err).Warnln("executor cleanup")
+	}
+}
+
+// executorOptions returns options of the job environment, the image names may refer to the job variables.
+// The services get the job variables along with their own ones.
+// The builds of the other jobs and the local caches of all projects are hidden from the job.
+func (b *Build) executorOptions(variables jobVariables) executor.Options {
+	expand := func(s string) string {
+		return os.Expand(s, func(key string) string {
+			value, _ := variables.Get(key)
+			return value
+		})
+	}
+
+	services := make([]executor.Service, 0, len(b.job.Services))
+
+	for _, service := range b.job.Services {
+		env := variables.Environ()
+
+		for _, variable := range service.Variables {
+			if !variable.Raw {
+				variable.Value = expand(variable.Value)
+			}
+
+			env = append(env, variable.Key+"="+variable.Value)
+		}
+
+		services = append(services, executor.Service{
+			Image: expand(service.Name),
+			// several aliases may be separated by commas or spaces.
+			Aliases: strings.FieldsFunc(service.Alias, func(r rune) bool {
+				return r == ',' || unicode.IsSpace(r)
+			}),
+			Entrypoint: service.Entrypoint,
+			Command:    service.Command,
+			Env:        env,
+		})
+	}
+
+	hidden := []string{b.buildsDir}
+	if b.config.Cache.Type != cacheTypeS3 {
+		hidden = append(hidden, localCacheDir(b.config))
+	}
+
+	return executor.Options{
+		Image:    expand(b.job.Image.Name),
+		Volumes:  []string{b.buildDir, b.tmpDir()},
+		Hidden:   hidden,
+		Services: services,
+	}
+}
+
+// prepare prepares the build environment and the repository in the build directory.
+func (b *Build) prepare(ctx context.Context) error {
+	b.setState(buildStatePreparing)
+
+	if err := b.checkRemoteFeatures(); err != nil {
+		return systemFailure(ctx, err)
+	}
+
+	if err := b.writeFileVariables(); err != nil {
+		return systemFailure(ctx, fmt.Errorf("file variables: %w", err))
+	}
+
+	variables := b.variables()
+
+	b.executor.Environment(variables.Environ())
+	b.executor.HomeDirectory(b.buildDir)
+
+	if err := b.executor.Prepare(ctx, b.executorOptions(variables), b.output); err != nil {
+		return systemFailure(ctx, fmt.Errorf("prepare executor: %w", err))
+	}
+
+	if err := b.getSources(ctx); err != nil {
+		return systemFailure(ctx, fmt.Errorf("get sources: %w", err))
+	}
+
+	b.restoreCache(ctx)
+
+	if err := b.downloadDependencies(ctx); err != nil {
+		return systemFailure(ctx, fmt.Errorf("dependencies: %w", err))
+	}
+
+	// the modification time shows when the build directory was used last time.
+	now := time.Now()
+	if err := os.Chtimes(b.buildDir, now, now); err != nil {
+		b.logger.WithError(err).Warnln("touch build dir")
+	}
+
+	b.logger.WithField("dir", b.buildDir).Infoln("repository was prepared")
+
+	return nil
+}
+
+// checkRemoteFeatures returns the error if the scripts run on another machine while the job needs
+// the files of the build directory on the runner host. The caches are skipped with a warning
+// since the job does not depend on them.
+func (b *Build) checkRemoteFeatures() error {
+	if !isRemoteExecutor(b.config.Executor) {
+		return nil
+	}
+
+	if len(b.job.Cache) > 0 {
+		b.trace(fmt.Sprintf(
+			"%sWARNING: cache is not supported by the %s executor%s\n",
+			ansiBoldYellow,
+			b.config.Executor,
+			ansiReset,
+		))
+	}
+
+	var features []string
+
+	for _, variable := range b.job.Variables {
+		if variable.File {
+			features = append(features, "file variables")
+			break
+		}
+	}
+
+	if len(b.job.Artifacts) > 0 {
+		features = append(features, "artifacts")
+	}
+
+	for _, dep := range b.job.Dependencies {
+		if dep.ArtifactsFile.Filename != "" {
+			features = append(features, "dependencies")
+			break
+		}
+	}
+
+	if len(features) > 0 {
+		return fmt.Errorf("%s are not supported by the %s executor", strings.Join(features, ", "), b.config.Executor)
+	}
+
+	return nil
+}
+
+// process prepares the build and executes the job steps according to their conditions,
+// the error of the first failed step is returned.
+func (b *Build) process(ctx context.Context) error {
+	if err := b.prepare(ctx); err != nil {
+		return fmt.Errorf("prepare error: %w", err)
+	}
+
+	b.setState(buildStateRunning)
+	b.trace("Running scripts:\n")
+
+	var failure error
+
+	for _, step := range b.job.Steps {
+		if step.Name == stepNameAfterScript || !step.shouldRun(failure != nil) {
+			continue
+		}
+
+		// the job was canceled or timed out, the rest of the steps can't be executed.
+		if ctx.Err() != nil {
+			if failure == nil {
+				failure = fmt.Errorf("%s: %w", step.Name, ctx.Err())
+			}
+
+			break
+		}
+
+		logger := b.logger.WithFields(logrus.Fields{"step_name": step.Name, "scripts_count": len(step.Script)})
+
+		if err := b.executeStep(ctx, step); err != nil {
+			if step.AllowFailure && ctx.Err() == nil {
+				logger.WithError(err).Warnln("step failed, failure is allowed")
+				b.trace(fmt.Sprintf("%sWARNING: %s failed, failure is allowed%s\n", ansiBoldYellow, step.Name, ansiReset))
+
+				continue
+			}
+
+			logger.WithError(err).Warnln("step failed")
+
+			if failure == nil {
+				failure = fmt.Errorf("%s: %w", step.Name, err)
+			}
+
+			continue
+		}
+
+		logger.Infoln("step was processed")
+	}
+
+	return failure
+}
+
+// executeStep executes all commands of the step as one script within the step timeout.
+func (b *Build) executeStep(ctx context.Context, step step) error {
+	if step.Timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(step.Timeout)*time.Second)
+		defer cancel()
+	}
+
+	return b.execute(executor.WithStage(ctx, stepStage(step)), stepScript(step))
+}
+
+// stepStage returns name of the job stage of the step, e.g. "step_script" for the main script.
+func stepStage(step step) string {
+	if step.Name == stepNameAfterScript {
+		return stageAfterScript
+	}
+
+	return stageStepPrefix + step.Name
+}
+
+// execute executes the script streaming its output into the job trace,
+// errors which are not caused by the script itself are failures of the runner.
+func (b *Build) execute(ctx context.Context, script string) error {
+	return systemFailure(ctx, b.executor.Execute(ctx, script, b.output))
+}
+
+// stepScript generates a single script from all the step commands.
+func stepScript(step step) string {
+	return executor.Script{Commands: step.Script}.String()
+}
+
+// systemError represent failure of the gitlab-runner itself rather than of the job.
+type systemError struct {
+	err error
+}
+
+// Error implements error interface.
+func (e *systemError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the original error.
+func (e *systemError) Unwrap() error {
+	return e.err
+}
+
+// systemFailure marks the error as a failure of the runner,
+// errors of the job script and errors caused by the context are returned as is.
+func systemFailure(ctx context.Context, err error) error {
+	var exitErr *executor.ExitError
+
+	if err == nil || ctx.Err() != nil || errors.As(err, &exitErr) {
+		return err
+	}
+
+	return &systemError{err: err}
+}
+
+// jobFailureReason classifies the job failure,
+// the timeout of a single step is distinguished from the timeout of the whole job.
+func jobFailureReason(jobCtx context.Context, err error) failureReason {
+	var (
+		exitErr *executor.ExitError
+		sysErr  *systemError
+	)
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) && errors.Is(jobCtx.Err(), context.DeadlineExceeded):
+		return failureReasonJobExecution
+	case errors.Is(err, context.DeadlineExceeded):
+		return failureReasonStuckOrTimeout
+	case errors.As(err, &sysErr):
+		return failureReasonRunnerSystem
+	case errors.As(err, &exitErr):
+		return failureReasonScript
+	default:
+		return failureReasonUnknown
+	}
+}
+
+// exitCode returns exit code of the failed script, zero if the failure was not caused by the script.
+func exitCode(err error) int {
+	var exitErr *executor.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Code
+	}
+
+	return 0
+}
@@ -0,0 +1,653 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/ihippik/gitlab-runner/config"
+	"github.com/ihippik/gitlab-runner/executor"
+)
+
+// gitlabTraceFake stores job traces in memory and validates trace offsets.
+type gitlabTraceFake struct {
+	GitlabAPIMock
+
+	mu      sync.Mutex
+	state   remoteJobState
+	traces  map[int][]byte
+	updates []*updateJobRequest
+	// updateDelay delays recording of the job updates as if they were slow requests.
+	updateDelay time.Duration
+}
+
+func (g *gitlabTraceFake) setState(state remoteJobState) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.state = state
+}
+
+func (g *gitlabTraceFake) jobTrace(
+	_ context.Context,
+	startOffset,
+	jobID int,
+	_ string,
+	content []byte,
+) (int, remoteJobState, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.state.isCanceled() {
+		return 0, g.state, assert.AnError
+	}
+
+	if startOffset != len(g.traces[jobID]) {
+		return 0, g.state, assert.AnError
+	}
+
+	g.traces[jobID] = append(g.traces[jobID], content...)
+
+	return startOffset + len(content), g.state, nil
+}
+
+func (g *gitlabTraceFake) updateJob(_ context.Context, _ int, req *updateJobRequest) (remoteJobState, error) {
+	time.Sleep(g.updateDelay)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.updates = append(g.updates, req)
+
+	return g.state, nil
+}
+
+// expectLifecycle sets up expectations of the job preparation, cloning of the repository and cleanup
+// of the executor, the scripts of the steps are expected by the tests themselves.
+func expectLifecycle(executor *ExecutorMock) {
+	executor.On(
+		"Execute",
+		mock.Anything,
+		mock.MatchedBy(func(cmd string) bool { return strings.Contains(cmd, "git fetch origin") }),
+	).Return("", nil).Once()
+	executor.On("Environment", mock.Anything).Once()
+	executor.On("HomeDirectory", mock.AnythingOfType("string")).Once()
+	executor.On("Prepare", mock.Anything).Return(nil).Once()
+	executor.On("Cleanup").Return(nil).Once()
+}
+
+func TestBuild_Run_concurrent(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	gitlab := &gitlabTraceFake{state: remoteJobStateRunning, traces: make(map[int][]byte)}
+	cfg := &config.RunnerCfg{Name: "my-gitlab-runner"}
+
+	newExecutor := func(output string) *ExecutorMock {
+		executor := new(ExecutorMock)
+		expectLifecycle(executor)
+		executor.On("Execute", mock.Anything, stepScript(step{Script: []string{"command"}})).Return(output, nil).Once()
+
+		return executor
+	}
+
+	buildsDir := t.TempDir()
+	builds := make([]*Build, 0, 2)
+
+	for id := 1; id <= 2; id++ {
+		job := &jobResponse{
+			ID:    id,
+			Token: "job-token",
+			Steps: []step{{Name: "step-name", Script: []string{"command"}}},
+		}
+
+		executor := newExecutor(strings.Repeat("x", id*10))
+		defer executor.AssertExpectations(t)
+
+		builds = append(builds, newBuild(logrus.NewEntry(logger), cfg, gitlab, executor, job, buildsDir, id))
+	}
+
+	var wg sync.WaitGroup
+
+	for _, build := range builds {
+		wg.Add(1)
+
+		go func(build *Build) {
+			defer wg.Done()
+			assert.NoError(t, build.Run(context.Background()))
+		}(build)
+	}
+
+	wg.Wait()
+
+	assert.NotEqual(t, builds[0].buildDir, builds[1].buildDir)
+
+	for _, build := range builds {
+		assert.Equal(t, buildStateSuccess, build.State())
+		assert.Equal(t, len(gitlab.traces[build.job.ID]), build.TraceOffset())
+		assert.Contains(
+			t,
+			string(gitlab.traces[build.job.ID]),
+			strings.Repeat("x", build.job.ID*10),
+		)
+	}
+}
+
+func TestBuild_Run_timeout(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	gitlab := &gitlabTraceFake{state: remoteJobStateRunning, traces: make(map[int][]byte)}
+	cfg := &config.RunnerCfg{Name: "my-gitlab-runner", MaximumTimeout: 100 * time.Millisecond}
+
+	executor := new(ExecutorMock)
+	expectLifecycle(executor)
+	executor.On("Execute", mock.Anything, stepScript(step{Script: []string{"sleep"}})).
+		Run(func(args mock.Arguments) {
+			<-args.Get(0).(context.Context).Done()
+		}).
+		Return("", context.DeadlineExceeded).
+		Once()
+
+	defer executor.AssertExpectations(t)
+
+	job := &jobResponse{
+		ID:         1,
+		Token:      "job-token",
+		RunnerInfo: jobRunnerInfo{Timeout: 3600},
+		Steps:      []step{{Name: "step-name", Script: []string{"sleep"}, Timeout: 3600}},
+	}
+
+	build := newBuild(logrus.NewEntry(logger), cfg, gitlab, executor, job, t.TempDir(), 0)
+
+	assert.Equal(t, 100*time.Millisecond, build.timeout())
+	assert.Error(t, build.Run(context.Background()))
+	assert.Equal(t, buildStateFailed, build.State())
+	assert.Contains(t, string(gitlab.traces[1]), "execution took longer than 100ms")
+
+	if assert.Len(t, gitlab.updates, 1) {
+		assert.Equal(t, failureReasonJobExecution, gitlab.updates[0].FailureReason)
+	}
+}
+
+func TestBuild_Run_timeoutBetweenSteps(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	gitlab := &gitlabTraceFake{state: remoteJobStateRunning, traces: make(map[int][]byte)}
+	cfg := &config.RunnerCfg{Name: "my-gitlab-runner", MaximumTimeout: 100 * time.Millisecond}
+
+	// the first step succeeds right when the job times out, the second one is never executed.
+	executor := new(ExecutorMock)
+	expectLifecycle(executor)
+	executor.On("Execute", mock.Anything, stepScript(step{Script: []string{"build"}})).
+		Run(func(args mock.Arguments) {
+			<-args.Get(0).(context.Context).Done()
+		}).
+		Return("", nil).
+		Once()
+
+	defer executor.AssertExpectations(t)
+
+	job := &jobResponse{
+		ID:    1,
+		Token: "job-token",
+		Steps: []step{
+			{Name: "build", Script: []string{"build"}},
+			{Name: "script", Script: []string{"test"}},
+		},
+	}
+
+	build := newBuild(logrus.NewEntry(logger), cfg, gitlab, executor, job, t.TempDir(), 0)
+
+	err := build.Run(context.Background())
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Equal(t, buildStateFailed, build.State())
+
+	if assert.Len(t, gitlab.updates, 1) {
+		assert.Equal(t, "failed", gitlab.updates[0].State)
+		assert.Equal(t, failureReasonJobExecution, gitlab.updates[0].FailureReason)
+	}
+}
+
+func TestBuild_Run_canceled(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	gitlab := &gitlabTraceFake{state: remoteJobStateRunning, traces: make(map[int][]byte)}
+	cfg := &config.RunnerCfg{Name: "my-gitlab-runner"}
+
+	executor := new(ExecutorMock)
+	expectLifecycle(executor)
+	executor.On("Execute", mock.Anything, stepScript(step{Script: []string{"sleep"}})).
+		Run(func(args mock.Arguments) {
+			gitlab.setState(remoteJobStateCanceling)
+			<-args.Get(0).(context.Context).Done()
+		}).
+		Return("", context.Canceled).
+		Once()
+	executor.On("Execute", mock.Anything, stepScript(step{Script: []string{"cleanup"}})).Return("", nil).Once()
+
+	defer executor.AssertExpectations(t)
+
+	job := &jobResponse{
+		ID:    1,
+		Token: "job-token",
+		Steps: []step{
+			{Name: "script", Script: []string{"sleep"}},
+			{Name: stepNameAfterScript, Script: []string{"cleanup"}, When: "always"},
+		},
+	}
+
+	build := newBuild(logrus.NewEntry(logger), cfg, gitlab, executor, job, t.TempDir(), 0)
+	build.statusInterval = 10 * time.Millisecond
+
+	assert.NoError(t, build.Run(context.Background()))
+	assert.Equal(t, buildStateCanceled, build.State())
+
+	for _, update := range gitlab.updates {
+		assert.Equal(t, string(remoteJobStateRunning), update.State)
+	}
+}
+
+func TestBuild_Run_keepaliveStopped(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	gitlab := &gitlabTraceFake{
+		state:       remoteJobStateRunning,
+		traces:      make(map[int][]byte),
+		updateDelay: 5 * time.Millisecond,
+	}
+
+	executor := new(ExecutorMock)
+	expectLifecycle(executor)
+	executor.On("Execute", mock.Anything, stepScript(step{Script: []string{"sleep"}})).
+		Run(func(mock.Arguments) { time.Sleep(30 * time.Millisecond) }).
+		Return("", nil).
+		Once()
+
+	defer executor.AssertExpectations(t)
+
+	job := &jobResponse{ID: 1, Token: "job-token", Steps: []step{{Name: "script", Script: []string{"sleep"}}}}
+
+	build := newBuild(logrus.NewEntry(logger), &config.RunnerCfg{}, gitlab, executor, job, t.TempDir(), 0)
+	build.statusInterval = time.Millisecond
+
+	assert.NoError(t, build.Run(context.Background()))
+
+	// the final state is the last update of the job even after the requests in flight are recorded.
+	time.Sleep(4 * gitlab.updateDelay)
+
+	gitlab.mu.Lock()
+	defer gitlab.mu.Unlock()
+
+	if assert.True(t, len(gitlab.updates) > 1) {
+		assert.Equal(t, "success", gitlab.updates[len(gitlab.updates)-1].State)
+	}
+}
+
+func TestBuild_variables(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	cfg := &config.RunnerCfg{Name: "my-gitlab-runner", Token: "0123456789abcdef", Tags: []string{"a", "b"}}
+	job := &jobResponse{
+		ID: 1,
+		Variables: jobVariables{
+			{Key: "CI_COMMIT_SHA", Value: "deadbeef"},
+			{Key: "ARTIFACT", Value: "$CI_PROJECT_DIR/bin/app-$CI_COMMIT_SHA"},
+		},
+	}
+
+	build := newBuild(logrus.NewEntry(logger), cfg, nil, nil, job, "/builds", 0)
+	build.buildDir = "/builds/project"
+	build.concurrentID = 3
+
+	variables := build.variables()
+
+	for key, want := range map[string]string{
+		"CI_SERVER":             "yes",
+		"CI_BUILDS_DIR":         "/builds",
+		"CI_PROJECT_DIR":        "/builds/project",
+		"CI_CONCURRENT_ID":      "3",
+		"CI_RUNNER_DESCRIPTION": "my-gitlab-runner",
+		"CI_RUNNER_TAGS":        "a, b",
+		"CI_RUNNER_SHORT_TOKEN": "01234567",
+		"CI_COMMIT_SHA":         "deadbeef",
+		"ARTIFACT":              "/builds/project/bin/app-deadbeef",
+	} {
+		got, ok := variables.Get(key)
+		assert.True(t, ok, key)
+		assert.Equal(t, want, got, key)
+	}
+}
+
+func TestBuild_fileVariables(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	job := &jobResponse{
+		ID: 1,
+		Variables: jobVariables{
+			{Key: "KUBECONFIG", Value: "apiVersion: v1", File: true},
+			{Key: "CONFIG_DIR", Value: "$KUBECONFIG.d"},
+		},
+	}
+
+	build := newBuild(logrus.NewEntry(logger), &config.RunnerCfg{}, nil, nil, job, t.TempDir(), 0)
+	build.buildDir = filepath.Join(build.buildsDir, "project")
+
+	assert.NoError(t, build.writeFileVariables())
+
+	path := filepath.Join(build.buildDir+".tmp", "KUBECONFIG")
+	variables := build.variables()
+
+	got, _ := variables.Get("KUBECONFIG")
+	assert.Equal(t, path, got)
+
+	got, _ = variables.Get("CONFIG_DIR")
+	assert.Equal(t, path+".d", got)
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "apiVersion: v1", string(data))
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	build.cleanup()
+
+	_, err = os.Stat(build.buildDir + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestBuild_checkRemoteFeatures(t *testing.T) {
+	tests := []struct {
+		name      string
+		executor  string
+		job       *jobResponse
+		wantTrace string
+		wantErr   string
+	}{
+		{
+			name:     "local executor",
+			executor: "shell",
+			job: &jobResponse{
+				Variables: jobVariables{{Key: "KUBECONFIG", Value: "apiVersion: v1", File: true}},
+				Artifacts: []artifact{{Paths: []string{"bin"}}},
+			},
+		},
+		{
+			name:     "remote executor without files",
+			executor: executorKindSSH,
+			job: &jobResponse{
+				Variables:    jobVariables{{Key: "GO_VERSION", Value: "1.17"}},
+				Dependencies: []dependency{{ID: 1, Name: "build"}},
+				Cache:        []jobCache{{Key: "go", Paths: []string{".cache"}}},
+			},
+			wantTrace: "cache is not supported by the ssh executor",
+		},
+		{
+			name:     "remote executor with files",
+			executor: executorKindCustom,
+			job: &jobResponse{
+				Variables: jobVariables{{Key: "KUBECONFIG", Value: "apiVersion: v1", File: true}},
+				Artifacts: []artifact{{Paths: []string{"bin"}}},
+				Dependencies: []dependency{
+					{ID: 1, Name: "build", ArtifactsFile: dependencyArtifactsFile{Filename: "artifacts.zip"}},
+				},
+			},
+			wantErr: "file variables, artifacts, dependencies are not supported by the custom executor",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, _ := test.NewNullLogger()
+			build := newBuild(logrus.NewEntry(logger), &config.RunnerCfg{Executor: tt.executor}, nil, nil, tt.job, "", 0)
+
+			var out bytes.Buffer
+			build.output = newMaskWriter(&out, nil, false)
+
+			err := build.checkRemoteFeatures()
+
+			assert.NoError(t, build.output.Flush())
+			assert.Contains(t, out.String(), tt.wantTrace)
+
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+
+			assert.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestBuild_Run_masked(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	gitlab := &gitlabTraceFake{state: remoteJobStateRunning, traces: make(map[int][]byte)}
+
+	executor := new(ExecutorMock)
+	expectLifecycle(executor)
+	executor.On("Execute", mock.Anything, stepScript(step{Script: []string{"env"}})).
+		Return("TOKEN=super-secret\n", nil).
+		Once()
+
+	defer executor.AssertExpectations(t)
+
+	job := &jobResponse{
+		ID:        1,
+		Token:     "job-token",
+		Variables: jobVariables{{Key: "TOKEN", Value: "super-secret", Masked: true}},
+		Steps:     []step{{Name: "script", Script: []string{"env"}}},
+	}
+
+	build := newBuild(logrus.NewEntry(logger), &config.RunnerCfg{}, gitlab, executor, job, t.TempDir(), 0)
+
+	assert.NoError(t, build.Run(context.Background()))
+	assert.Contains(t, string(gitlab.traces[1]), "TOKEN=[MASKED]\n")
+	assert.NotContains(t, string(gitlab.traces[1]), "super-secret")
+}
+
+func TestBuild_executorOptions(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	job := &jobResponse{
+		ID:    1,
+		Image: jobImage{Name: "golang:$GO_VERSION"},
+		Services: []jobService{
+			{
+				Name:      "postgres:$PG_VERSION",
+				Alias:     "db, postgres-db",
+				Variables: jobVariables{{Key: "POSTGRES_DB", Value: "$DB_NAME"}, {Key: "RAW", Value: "$DB_NAME", Raw: true}},
+			},
+			{Name: "redis", Command: []string{"redis-server"}},
+		},
+		Variables: jobVariables{
+			{Key: "GO_VERSION", Value: "1.17"},
+			{Key: "PG_VERSION", Value: "14"},
+			{Key: "DB_NAME", Value: "test"},
+		},
+	}
+
+	cfg := &config.RunnerCfg{CacheDir: "/cache"}
+
+	build := newBuild(logrus.NewEntry(logger), cfg, nil, nil, job, "/builds", 0)
+	build.buildDir = "/builds/project"
+
+	options := build.executorOptions(job.Variables)
+	assert.Equal(t, "golang:1.17", options.Image)
+	assert.Equal(t, []string{"/builds/project", "/builds/project.tmp"}, options.Volumes)
+	assert.Equal(t, []string{"/builds", "/cache"}, options.Hidden)
+
+	if assert.Len(t, options.Services, 2) {
+		assert.Equal(t, "postgres:14", options.Services[0].Image)
+		assert.Equal(t, []string{"db", "postgres-db"}, options.Services[0].Aliases)
+		assert.Contains(t, options.Services[0].Env, "DB_NAME=test")
+		assert.Contains(t, options.Services[0].Env, "POSTGRES_DB=test")
+		assert.Contains(t, options.Services[0].Env, "RAW=$DB_NAME")
+
+		assert.Empty(t, options.Services[1].Aliases)
+		assert.Equal(t, []string{"redis-server"}, options.Services[1].Command)
+	}
+}
+
+func TestBuild_Run_image(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	gitlab := &gitlabTraceFake{state: remoteJobStateRunning, traces: make(map[int][]byte)}
+
+	job := &jobResponse{
+		ID:        1,
+		Token:     "job-token",
+		Image:     jobImage{Name: "golang:$GO_VERSION"},
+		Variables: jobVariables{{Key: "GO_VERSION", Value: "1.17"}},
+		Steps:     []step{{Name: "script", Script: []string{"go test"}}},
+	}
+
+	build := newBuild(logrus.NewEntry(logger), &config.RunnerCfg{}, gitlab, nil, job, t.TempDir(), 0)
+
+	// the image can't be pulled, so the scripts are not executed.
+	executorMock := new(ExecutorMock)
+	executorMock.On("Environment", mock.Anything).Once()
+	executorMock.On("HomeDirectory", mock.AnythingOfType("string")).Once()
+	executorMock.On("Prepare", mock.MatchedBy(func(options executor.Options) bool {
+		return options.Image == "golang:1.17" &&
+			assert.ObjectsAreEqual([]string{build.buildDir, build.buildDir + ".tmp"}, options.Volumes)
+	})).Return(assert.AnError).Once()
+	executorMock.On("Cleanup").Return(nil).Once()
+
+	defer executorMock.AssertExpectations(t)
+
+	build.executor = executorMock
+
+	assert.Error(t, build.Run(context.Background()))
+
+	if assert.Len(t, gitlab.updates, 1) {
+		assert.Equal(t, failureReasonRunnerSystem, gitlab.updates[0].FailureReason)
+	}
+}
+
+func TestBuild_Run_steps(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	gitlab := &gitlabTraceFake{state: remoteJobStateRunning, traces: make(map[int][]byte)}
+	cfg := &config.RunnerCfg{Name: "my-gitlab-runner"}
+	scriptFailure := &executor.ExitError{Code: 3}
+
+	executor := new(ExecutorMock)
+	expectLifecycle(executor)
+	executor.On("Execute", mock.Anything, stepScript(step{Script: []string{"lint"}})).Return("", assert.AnError).Once()
+	executor.On("Execute", mock.Anything, stepScript(step{Script: []string{"test"}})).Return("", scriptFailure).Once()
+	executor.On("Execute", mock.Anything, stepScript(step{Script: []string{"report"}})).Return("", nil).Once()
+	executor.On("Execute", mock.Anything, stepScript(step{Script: []string{"cleanup"}})).Return("", assert.AnError).Once()
+
+	defer executor.AssertExpectations(t)
+
+	job := &jobResponse{
+		ID:    1,
+		Token: "job-token",
+		Steps: []step{
+			{Name: "lint", Script: []string{"lint"}, AllowFailure: true},
+			{Name: "script", Script: []string{"test"}, When: stepWhenOnSuccess},
+			{Name: "deploy", Script: []string{"deploy"}, When: stepWhenOnSuccess},
+			{Name: "report", Script: []string{"report"}, When: stepWhenOnFailure},
+			{Name: stepNameAfterScript, Script: []string{"cleanup"}, When: stepWhenAlways},
+		},
+	}
+
+	build := newBuild(logrus.NewEntry(logger), cfg, gitlab, executor, job, t.TempDir(), 0)
+
+	err := build.Run(context.Background())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "script: ")
+	assert.Equal(t, buildStateFailed, build.State())
+
+	trace := string(gitlab.traces[1])
+	assert.Contains(t, trace, "WARNING: lint failed, failure is allowed")
+	assert.Contains(t, trace, "Running after_script")
+	assert.Contains(t, trace, "WARNING: after_script failed, but job will continue unaffected")
+
+	if assert.Len(t, gitlab.updates, 1) {
+		assert.Equal(t, "failed", gitlab.updates[0].State)
+		assert.Equal(t, failureReasonScript, gitlab.updates[0].FailureReason)
+		assert.Equal(t, 3, gitlab.updates[0].ExitCode)
+	}
+}
+
+func TestJobFailureReason(t *testing.T) {
+	expired, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+
+	<-expired.Done()
+
+	tests := []struct {
+		name   string
+		jobCtx context.Context
+		err    error
+		want   failureReason
+	}{
+		{
+			name:   "script",
+			jobCtx: context.Background(),
+			err:    fmt.Errorf("script: %w", &executor.ExitError{Code: 1}),
+			want:   failureReasonScript,
+		},
+		{
+			name:   "runner system",
+			jobCtx: context.Background(),
+			err:    systemFailure(context.Background(), errors.New("no space left on device")),
+			want:   failureReasonRunnerSystem,
+		},
+		{
+			name:   "job timeout",
+			jobCtx: expired,
+			err:    fmt.Errorf("script: %w", context.DeadlineExceeded),
+			want:   failureReasonJobExecution,
+		},
+		{
+			name:   "step timeout",
+			jobCtx: context.Background(),
+			err:    fmt.Errorf("script: %w", context.DeadlineExceeded),
+			want:   failureReasonStuckOrTimeout,
+		},
+		{
+			name:   "unknown",
+			jobCtx: context.Background(),
+			err:    context.Canceled,
+			want:   failureReasonUnknown,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, jobFailureReason(tt.jobCtx, tt.err))
+		})
+	}
+
+	assert.Equal(t, 1, exitCode(fmt.Errorf("script: %w", &executor.ExitError{Code: 1})))
+	assert.Equal(t, 0, exitCode(errors.New("no space left on device")))
+}
+
+func TestStep_shouldRun(t *testing.T) {
+	tests := []struct {
+		when      string
+		onSuccess bool
+		onFailure bool
+	}{
+		{when: "", onSuccess: true, onFailure: false},
+		{when: stepWhenOnSuccess, onSuccess: true, onFailure: false},
+		{when: stepWhenOnFailure, onSuccess: false, onFailure: true},
+		{when: stepWhenAlways, onSuccess: true, onFailure: true},
+	}
+
+	for _, tt := range tests {
+		s := step{When: tt.when}
+		assert.Equal(t, tt.onSuccess, s.shouldRun(false), tt.when)
+		assert.Equal(t, tt.onFailure, s.shouldRun(true), tt.when)
+	}
+}
+
+func TestStepStage(t *testing.T) {
+	assert.Equal(t, "step_script", stepStage(step{Name: "script"}))
+	assert.Equal(t, "step_release", stepStage(step{Name: "release"}))
+	assert.Equal(t, "after_script", stepStage(step{Name: stepNameAfterScript}))
+}
@@ -0,0 +1,192 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/ihippik/gitlab-runner/artifacts"
+	"github.com/ihippik/gitlab-runner/cache"
+	"github.com/ihippik/gitlab-runner/config"
+)
+
+const (
+	// cacheTypeS3 type of the S3-compatible cache storage.
+	cacheTypeS3 = "s3"
+	// defaultCacheDir directory of the local cache storage used when the cache dir is not configured.
+	defaultCacheDir = "cache"
+	// defaultCacheKey key of the cache used when the job does not define it.
+	defaultCacheKey = "default"
+	// cacheArchiveName name of the cache archive in the storage.
+	cacheArchiveName = "cache.zip"
+)
+
+// newCacheBackend returns storage of the job caches according to the config, nil if the cache is unavailable.
+func newCacheBackend(logger *logrus.Entry, cfg *config.RunnerCfg) cache.Backend {
+	if cfg.Cache.Type == cacheTypeS3 {
+		backend, err := cache.NewS3Backend(cfg.Cache.S3, http.DefaultClient)
+		if err != nil {
+			logger.WithError(err).Warnln("s3 cache is disabled")
+			return nil
+		}
+
+		return backend
+	}
+
+	return cache.NewLocalBackend(localCacheDir(cfg))
+}
+
+// localCacheDir returns absolute path of the local cache storage.
+func localCacheDir(cfg *config.RunnerCfg) string {
+	dir := cfg.CacheDir
+	if dir == "" {
+		dir = defaultCacheDir
+	}
+
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+
+	return dir
+}
+
+// shouldSave reports whether the cache must be saved according to its policy and condition.
+func (c jobCache) shouldSave(failed bool) bool {
+	return c.Policy != cache.PolicyPull && whenMatches(c.When, failed)
+}
+
+// shouldRestore reports whether the cache must be restored according to its policy.
+func (c jobCache) shouldRestore() bool {
+	return c.Policy != cache.PolicyPush
+}
+
+// restoreCache extracts the job caches into the build directory,
+// the fallback keys are used if the cache of the key does not exist. Failures do not fail the job.
+func (b *Build) restoreCache(ctx context.Context) {
+	if b.cacheBackend == nil || isRemoteExecutor(b.config.Executor) {
+		return
+	}
+
+	variables := b.variables()
+
+	for _, item := range b.job.Cache {
+		if !item.shouldRestore() {
+			continue
+		}
+
+		keys := append([]string{item.Key}, item.FallbackKeys...)
+		if fallback, ok := variables.Get("CACHE_FALLBACK_KEY"); ok {
+			keys = append(keys, fallback)
+		}
+
+		names := make([]string, 0, len(keys))
+		nameKeys := make(map[string]string, len(keys))
+
+		for _, key := range keys {
+			key, err := cacheKey(variables, key)
+			if err != nil {
+				b.trace(fmt.Sprintf("%sWARNING: %s%s\n", ansiBoldYellow, err, ansiReset))
+				continue
+			}
+
+			name := b.cacheName(variables, key)
+			names = append(names, name)
+			nameKeys[name] = key
+		}
+
+		if len(names) == 0 {
+			continue
+		}
+
+		b.trace(fmt.Sprintf("Checking cache for %s...\n", nameKeys[names[0]]))
+
+		name, err := cache.Restore(ctx, b.cacheBackend, b.buildDir, b.tmpDir(), names)
+
+		switch {
+		case errors.Is(err, cache.ErrNotFound):
+			b.trace(fmt.Sprintf("%sWARNING: cache %s not found%s\n", ansiBoldYellow, nameKeys[names[0]], ansiReset))
+		case err != nil:
+			b.logger.WithError(err).Warnln("restore cache")
+			b.trace(fmt.Sprintf("%sWARNING: failed to extract cache: %s%s\n", ansiBoldYellow, err, ansiReset))
+		default:
+			b.trace(fmt.Sprintf("%sSuccessfully extracted cache %s%s\n", ansiBoldGreen, nameKeys[name], ansiReset))
+		}
+	}
+}
+
+// saveCache archives the job caches according to their policy and condition.
+// Failures do not fail the job.
+func (b *Build) saveCache(ctx context.Context, failed bool) {
+	if b.cacheBackend == nil || isRemoteExecutor(b.config.Executor) {
+		return
+	}
+
+	variables := b.variables()
+
+	for _, item := range b.job.Cache {
+		if !item.shouldSave(failed) {
+			continue
+		}
+
+		key, err := cacheKey(variables, item.Key)
+		if err != nil {
+			b.trace(fmt.Sprintf("%sWARNING: %s%s\n", ansiBoldYellow, err, ansiReset))
+			continue
+		}
+
+		b.trace(fmt.Sprintf("Creating cache %s...\n", key))
+
+		n, err := cache.Save(
+			ctx,
+			b.cacheBackend,
+			b.buildDir,
+			b.tmpDir(),
+			b.cacheName(variables, key),
+			artifacts.Options{Paths: item.Paths, Untracked: item.Untracked},
+		)
+
+		switch {
+		case err != nil:
+			b.logger.WithError(err).Warnln("save cache")
+			b.trace(fmt.Sprintf("%sWARNING: failed to create cache: %s%s\n", ansiBoldYellow, err, ansiReset))
+		case n == 0:
+			b.trace(fmt.Sprintf("%sWARNING: no files to cache for %s%s\n", ansiBoldYellow, key, ansiReset))
+		default:
+			b.trace(fmt.Sprintf("%sCreated cache %s (%d files)%s\n", ansiBoldGreen, key, n, ansiReset))
+		}
+	}
+}
+
+// cacheName returns name of the cache archive in the storage, caches are separated by runners and projects.
+func (b *Build) cacheName(variables jobVariables, key string) string {
+	project, ok := variables.Get("CI_PROJECT_ID")
+	if !ok {
+		project = projectPath(b.job)
+	}
+
+	return strings.Join([]string{"runner", shortToken(b.config.Token), "project", project, key, cacheArchiveName}, "/")
+}
+
+// cacheKey expands the job variables in the cache key, the key can't refer to other directories.
+func cacheKey(variables jobVariables, key string) (string, error) {
+	key = strings.TrimSpace(os.Expand(key, func(name string) string {
+		value, _ := variables.Get(name)
+		return value
+	}))
+
+	if key == "" {
+		return defaultCacheKey, nil
+	}
+
+	if key == "." || key == ".." || strings.Contains(key, "/") || strings.Contains(strings.ToLower(key), "%2f") {
+		return "", fmt.Errorf("invalid cache key %q", key)
+	}
+
+	return key, nil
+}
@@ -0,0 +1,107 @@
+package runner
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ihippik/gitlab-runner/cache"
+	"github.com/ihippik/gitlab-runner/config"
+)
+
+func TestBuild_cache(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	backend := cache.NewLocalBackend(t.TempDir())
+	cfg := &config.RunnerCfg{Token: "0123456789abcdef"}
+
+	newCacheBuild := func(ref string, item jobCache) (*Build, *gitlabTraceFake) {
+		gitlab := &gitlabTraceFake{state: remoteJobStateRunning, traces: make(map[int][]byte)}
+		job := &jobResponse{
+			ID: 1,
+			Variables: jobVariables{
+				{Key: "CI_PROJECT_ID", Value: "42"},
+				{Key: "CI_COMMIT_REF_SLUG", Value: ref},
+			},
+			Cache: []jobCache{item},
+		}
+
+		build := newBuild(logrus.NewEntry(logger), cfg, gitlab, nil, job, t.TempDir(), 0)
+		build.cacheBackend = backend
+		build.tracer = newTraceWriter(context.Background(), gitlab, job, 0, 0, func() {})
+		build.output = newMaskWriter(build.tracer, nil, false)
+
+		assert.NoError(t, os.MkdirAll(build.tmpDir(), 0o700))
+
+		return build, gitlab
+	}
+
+	trace := func(build *Build, gitlab *gitlabTraceFake) string {
+		assert.NoError(t, build.tracer.Close())
+		return string(gitlab.traces[1])
+	}
+
+	// the main branch pushes the cache.
+	build, gitlab := newCacheBuild("main", jobCache{Key: "$CI_COMMIT_REF_SLUG", Paths: []string{"vendor/"}})
+	assert.NoError(t, os.MkdirAll(filepath.Join(build.buildDir, "vendor"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(build.buildDir, "vendor", "modules.txt"), []byte("mod"), 0o644))
+
+	build.saveCache(context.Background(), false)
+	assert.Contains(t, trace(build, gitlab), "Created cache main (1 files)")
+	assert.FileExists(t, filepath.Join(build.buildDir, "vendor", "modules.txt"))
+
+	// the feature branch has no cache yet, the fallback key is used.
+	build, gitlab = newCacheBuild("feature", jobCache{
+		Key:          "$CI_COMMIT_REF_SLUG",
+		FallbackKeys: []string{"main"},
+		Policy:       cache.PolicyPull,
+		Paths:        []string{"vendor/"},
+	})
+
+	build.restoreCache(context.Background())
+	build.saveCache(context.Background(), false)
+
+	out := trace(build, gitlab)
+	assert.Contains(t, out, "Checking cache for feature...")
+	assert.Contains(t, out, "Successfully extracted cache main")
+	assert.NotContains(t, out, "Creating cache")
+	assert.FileExists(t, filepath.Join(build.buildDir, "vendor", "modules.txt"))
+
+	// push policy never restores the cache.
+	build, gitlab = newCacheBuild("main", jobCache{Key: "main", Policy: cache.PolicyPush, Paths: []string{"vendor/"}})
+
+	build.restoreCache(context.Background())
+	assert.NotContains(t, trace(build, gitlab), "Checking cache")
+	assertNotExist(t, filepath.Join(build.buildDir, "vendor"))
+}
+
+func TestCacheKey(t *testing.T) {
+	variables := jobVariables{{Key: "CI_COMMIT_REF_SLUG", Value: "main"}, {Key: "BAD", Value: "../etc"}}
+
+	tests := []struct {
+		key     string
+		want    string
+		wantErr bool
+	}{
+		{key: "", want: defaultCacheKey},
+		{key: "go-$CI_COMMIT_REF_SLUG", want: "go-main"},
+		{key: "..", wantErr: true},
+		{key: "$BAD", wantErr: true},
+		{key: "a%2Fb", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := cacheKey(variables, tt.key)
+		if tt.wantErr {
+			assert.Error(t, err, tt.key)
+			continue
+		}
+
+		assert.NoError(t, err, tt.key)
+		assert.Equal(t, tt.want, got, tt.key)
+	}
+}
@@ -0,0 +1,185 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/ihippik/gitlab-runner/config"
+)
+
+// cleanup policies of the build directories.
+const (
+	cleanupPolicyNever     = "never"
+	cleanupPolicyAlways    = "always"
+	cleanupPolicyOnSuccess = "on_success"
+	cleanupPolicyKeepLast  = "keep_last"
+)
+
+// buildsCleaner removes build directories according to the cleanup policy.
+type buildsCleaner struct {
+	logger *logrus.Entry
+	cfg    config.CleanupCfg
+	root   string
+}
+
+// newBuildsCleaner create new cleaner of the build directories stored in the root directory.
+func newBuildsCleaner(logger *logrus.Entry, cfg config.CleanupCfg, root string) *buildsCleaner {
+	if cfg.Policy == "" {
+		cfg.Policy = cleanupPolicyNever
+	}
+
+	return &buildsCleaner{logger: logger, cfg: cfg, root: root}
+}
+
+// projectDir represent build directory of the project.
+type projectDir struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// clean applies cleanup policy after the build, active build directories are never removed.
+func (c *buildsCleaner) clean(build *Build, active map[string]struct{}) {
+	switch c.cfg.Policy {
+	case cleanupPolicyAlways:
+		c.remove(build.buildDir)
+	case cleanupPolicyOnSuccess:
+		if build.State() == buildStateSuccess {
+			c.remove(build.buildDir)
+		}
+	case cleanupPolicyKeepLast:
+		if err := c.keepLast(active); err != nil {
+			c.logger.WithError(err).Warnln("keep last build directories")
+		}
+	}
+
+	if c.cfg.MaxDiskUsage > 0 {
+		if err := c.limitDiskUsage(active); err != nil {
+			c.logger.WithError(err).Warnln("limit disk usage of build directories")
+		}
+	}
+}
+
+// keepLast removes all but the most recently used build directories.
+func (c *buildsCleaner) keepLast(active map[string]struct{}) error {
+	dirs, err := c.projectDirs()
+	if err != nil {
+		return err
+	}
+
+	for i, dir := range dirs {
+		if i < c.cfg.KeepLast {
+			continue
+		}
+
+		if _, ok := active[dir.path]; !ok {
+			c.remove(dir.path)
+		}
+	}
+
+	return nil
+}
+
+// limitDiskUsage removes the least recently used build directories until the size limit is met.
+func (c *buildsCleaner) limitDiskUsage(active map[string]struct{}) error {
+	dirs, err := c.projectDirs()
+	if err != nil {
+		return err
+	}
+
+	var usage int64
+	for _, dir := range dirs {
+		usage += dir.size
+	}
+
+	for i := len(dirs) - 1; i >= 0 && usage > c.cfg.MaxDiskUsage; i-- {
+		if _, ok := active[dirs[i].path]; ok {
+			continue
+		}
+
+		c.remove(dirs[i].path)
+		usage -= dirs[i].size
+	}
+
+	return nil
+}
+
+// projectDirs returns build directories of the projects, the most recently used first.
+// Project directory is recognized by the git repository inside it.
+func (c *buildsCleaner) projectDirs() ([]projectDir, error) {
+	var dirs []projectDir
+
+	err := filepath.Walk(c.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		if !info.IsDir() {
+			return nil
+		}
+
+		if _, err := os.Stat(filepath.Join(path, ".git")); err != nil {
+			return nil
+		}
+
+		size, err := dirSize(path)
+		if err != nil {
+			return err
+		}
+
+		dirs = append(dirs, projectDir{path: path, size: size, modTime: info.ModTime()})
+
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walk: %w", err)
+	}
+
+	sort.Slice(dirs, func(i, j int) bool {
+		return dirs[i].modTime.After(dirs[j].modTime)
+	})
+
+	return dirs, nil
+}
+
+// remove removes build directory.
+func (c *buildsCleaner) remove(dir string) {
+	if dir == "" {
+		return
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		c.logger.WithError(err).WithField("dir", dir).Warnln("remove build directory")
+		return
+	}
+
+	c.logger.WithField("dir", dir).Infoln("build directory was removed")
+}
+
+// dirSize returns total size of the files in the directory.
+func dirSize(dir string) (int64, error) {
+	var size int64
+
+	err := filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			size += info.Size()
+		}
+
+		return nil
+	})
+
+	return size, err
+}
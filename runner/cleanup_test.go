@@ -0,0 +1,115 @@
+package runner
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ihippik/gitlab-runner/config"
+)
+
+// makeProjectDir creates build directory with git repository and a file of the specified size.
+func makeProjectDir(t *testing.T, root, path string, size int, age time.Duration) string {
+	t.Helper()
+
+	dir := filepath.Join(root, path)
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, ".git"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "data"), make([]byte, size), 0o644))
+
+	modTime := time.Now().Add(-age)
+	assert.NoError(t, os.Chtimes(dir, modTime, modTime))
+
+	return dir
+}
+
+func TestBuildsCleaner_clean(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+
+	tests := []struct {
+		name        string
+		cfg         config.CleanupCfg
+		state       buildState
+		wantRemoved []int
+	}{
+		{
+			name:  "never",
+			cfg:   config.CleanupCfg{},
+			state: buildStateSuccess,
+		},
+		{
+			name:        "always",
+			cfg:         config.CleanupCfg{Policy: cleanupPolicyAlways},
+			state:       buildStateFailed,
+			wantRemoved: []int{0},
+		},
+		{
+			name:        "on success",
+			cfg:         config.CleanupCfg{Policy: cleanupPolicyOnSuccess},
+			state:       buildStateSuccess,
+			wantRemoved: []int{0},
+		},
+		{
+			name:  "on success: failed",
+			cfg:   config.CleanupCfg{Policy: cleanupPolicyOnSuccess},
+			state: buildStateFailed,
+		},
+		{
+			name:        "keep last",
+			cfg:         config.CleanupCfg{Policy: cleanupPolicyKeepLast, KeepLast: 1},
+			state:       buildStateSuccess,
+			wantRemoved: []int{2},
+		},
+		{
+			name:        "max disk usage",
+			cfg:         config.CleanupCfg{MaxDiskUsage: 250},
+			state:       buildStateSuccess,
+			wantRemoved: []int{2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dirs := []string{
+				makeProjectDir(t, root, "0/group/project", 100, time.Minute),
+				makeProjectDir(t, root, "1/group/sub/project", 100, 2*time.Hour),
+				makeProjectDir(t, root, "0/group/old", 100, 3*time.Hour),
+			}
+
+			build := &Build{buildDir: dirs[0], state: tt.state}
+			active := map[string]struct{}{dirs[1]: {}}
+
+			newBuildsCleaner(logrus.NewEntry(logger), tt.cfg, root).clean(build, active)
+
+			for i, dir := range dirs {
+				_, err := os.Stat(dir)
+				removed := false
+
+				for _, idx := range tt.wantRemoved {
+					removed = removed || idx == i
+				}
+
+				assert.Equal(t, removed, os.IsNotExist(err), dir)
+			}
+		})
+	}
+}
+
+func TestProjectPath(t *testing.T) {
+	assert.Equal(
+		t,
+		"group/sub/project",
+		projectPath(&jobResponse{GitInfo: jobGitInfo{RepoURL: "https://token@gitlab.com/group/sub/project.git"}}),
+	)
+	assert.Equal(
+		t,
+		"group/project",
+		projectPath(&jobResponse{Variables: jobVariables{{Key: "CI_PROJECT_PATH", Value: "../../group/project"}}}),
+	)
+	assert.Equal(t, "project-3", projectPath(&jobResponse{ID: 3}))
+}
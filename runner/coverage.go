@@ -0,0 +1,129 @@
+package runner
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxCoverageLine longer lines of the job trace are not scanned for the coverage.
+const maxCoverageLine = 64 * 1024
+
+// coverageNumber number of the coverage percentage in the matched text.
+var coverageNumber = regexp.MustCompile(`\d+(?:\.\d+)?`)
+
+// coverageScanner scans the job trace line by line for the test coverage, the last match wins.
+type coverageScanner struct {
+	re *regexp.Regexp
+
+	mu       sync.Mutex
+	line     []byte
+	skipLine bool
+	value    *float64
+}
+
+// newCoverageScanner create new scanner of the coverage regex, the regex may be enclosed in slashes.
+func newCoverageScanner(pattern string) (*coverageScanner, error) {
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		pattern = pattern[1 : len(pattern)-1]
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("compile coverage regex: %w", err)
+	}
+
+	return &coverageScanner{re: re}, nil
+}
+
+// Write implements io.Writer.
+func (c *coverageScanner) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data := p
+
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			c.appendLine(data)
+			break
+		}
+
+		c.appendLine(data[:i])
+		c.scanLine()
+		data = data[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// appendLine appends data to the current line, too long lines are skipped.
+func (c *coverageScanner) appendLine(data []byte) {
+	if c.skipLine {
+		return
+	}
+
+	if len(c.line)+len(data) > maxCoverageLine {
+		c.skipLine = true
+		c.line = c.line[:0]
+
+		return
+	}
+
+	c.line = append(c.line, data...)
+}
+
+// scanLine matches the current line and starts a new one.
+func (c *coverageScanner) scanLine() {
+	if !c.skipLine {
+		if value, ok := c.match(c.line); ok {
+			c.value = &value
+		}
+	}
+
+	c.line = c.line[:0]
+	c.skipLine = false
+}
+
+// match returns the coverage of the line, the last non-empty submatch is used if the regex has groups.
+func (c *coverageScanner) match(line []byte) (float64, bool) {
+	matches := c.re.FindSubmatch(line)
+	if matches == nil {
+		return 0, false
+	}
+
+	text := matches[0]
+
+	for i := len(matches) - 1; i > 0; i-- {
+		if len(matches[i]) > 0 {
+			text = matches[i]
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(string(coverageNumber.Find(text)), 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return value, true
+}
+
+// Value returns the found coverage, nil if the coverage was not found.
+func (c *coverageScanner) Value() *float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// the last line of the trace may have no line break.
+	if len(c.line) > 0 && !c.skipLine {
+		if value, ok := c.match(c.line); ok {
+			return &value
+		}
+	}
+
+	return c.value
+}
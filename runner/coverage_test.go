@@ -0,0 +1,64 @@
+package runner
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoverageScanner(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		chunks  []string
+		want    *float64
+	}{
+		{
+			name:    "go test",
+			pattern: `/coverage: \d+\.\d+% of statements/`,
+			chunks:  []string{"ok  \tpkg/a\tcoverage: 71.", "4% of statements\nok  \tpkg/b\tcoverage: 80.5% of statements\n"},
+			want:    floatPtr(80.5),
+		},
+		{
+			name:    "submatch",
+			pattern: `^TOTAL.+?(\d+%)$`,
+			chunks:  []string{"Name Stmts Miss Cover\n", "TOTAL 120 30 75%"},
+			want:    floatPtr(75),
+		},
+		{
+			name:    "not found",
+			pattern: `Lines:\s*(\d+\.\d+)%`,
+			chunks:  []string{"no coverage\n"},
+		},
+		{
+			name:    "long line",
+			pattern: `coverage: (\d+)%`,
+			chunks:  []string{"coverage: 10%\n", strings.Repeat("x", maxCoverageLine), "coverage: 90%\n"},
+			want:    floatPtr(10),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scanner, err := newCoverageScanner(tt.pattern)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			for _, chunk := range tt.chunks {
+				_, err := scanner.Write([]byte(chunk))
+				assert.NoError(t, err)
+			}
+
+			assert.Equal(t, tt.want, scanner.Value())
+		})
+	}
+
+	_, err := newCoverageScanner(`/(unclosed/`)
+	assert.Error(t, err)
+}
+
+func floatPtr(v float64) *float64 {
+	return &v
+}
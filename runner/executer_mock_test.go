@@ -2,8 +2,11 @@ package runner
 
 import (
 	"context"
+	"io"
 
 	"github.com/stretchr/testify/mock"
+
+	"github.com/ihippik/gitlab-runner/executor"
 )
 
 type ExecutorMock struct {
@@ -11,10 +14,29 @@ type ExecutorMock struct {
 }
 
 func (e *ExecutorMock) HomeDirectory(dir string) {
-	panic("implement me")
+	e.Called(dir)
+}
+
+func (e *ExecutorMock) Environment(env []string) {
+	e.Called(env)
+}
+
+func (e *ExecutorMock) Prepare(_ context.Context, options executor.Options, _ io.Writer) error {
+	return e.Called(options).Error(0)
 }
 
-func (e *ExecutorMock) Execute(ctx context.Context, command string) (string, error) {
+func (e *ExecutorMock) Cleanup(_ context.Context) error {
+	return e.Called().Error(0)
+}
+
+func (e *ExecutorMock) Execute(ctx context.Context, command string, output io.Writer) error {
 	args := e.Called(ctx, command)
-	return args.String(0), args.Error(1)
+
+	if out := args.String(0); out != "" {
+		if _, err := output.Write([]byte(out)); err != nil {
+			return err
+		}
+	}
+
+	return args.Error(1)
 }
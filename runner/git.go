@@ -0,0 +1,284 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/ihippik/gitlab-runner/executor"
+)
+
+// git strategies of the repository preparation.
+const (
+	gitStrategyClone = "clone"
+	gitStrategyFetch = "fetch"
+	gitStrategyNone  = "none"
+)
+
+// defaultGitCleanFlags flags of the git clean used when GIT_CLEAN_FLAGS is not set.
+const defaultGitCleanFlags = "-ffdx"
+
+// git submodule strategies, submodules are not updated by default.
+const (
+	gitSubmoduleStrategyNormal    = "normal"
+	gitSubmoduleStrategyRecursive = "recursive"
+)
+
+// gitLFSPull command which pulls LFS objects if git-lfs is installed.
+const gitLFSPull = "if git lfs version >/dev/null 2>&1; then git lfs pull; fi"
+
+// defaultGitRefspecs refspecs fetched when the Gitlab did not send them.
+var defaultGitRefspecs = []string{"+refs/heads/*:refs/remotes/origin/*", "+refs/tags/*:refs/tags/*"}
+
+// gitStrategy returns git strategy of the job,
+// fetch is used by default if the Gitlab allows it.
+func (b *Build) gitStrategy(variables jobVariables) string {
+	strategy, _ := variables.Get("GIT_STRATEGY")
+
+	switch strategy {
+	case gitStrategyClone, gitStrategyFetch, gitStrategyNone:
+		return strategy
+	}
+
+	if b.job.AllowGitFetch {
+		return gitStrategyFetch
+	}
+
+	return gitStrategyClone
+}
+
+// getSources prepares the repository in the build directory according to the git strategy.
+// A broken repository is cloned from scratch if fetching fails.
+func (b *Build) getSources(ctx context.Context) error {
+	ctx = executor.WithStage(ctx, stageGetSources)
+	variables := b.variables()
+
+	switch b.gitStrategy(variables) {
+	case gitStrategyNone:
+		b.trace(fmt.Sprintf("%sSkipping Git repository setup%s\n", ansiBoldYellow, ansiReset))
+
+		if err := os.MkdirAll(b.buildDir, 0o755); err != nil {
+			return fmt.Errorf("make build dir: %w", err)
+		}
+
+		return nil
+	case gitStrategyFetch:
+		if err := os.MkdirAll(b.buildDir, 0o755); err != nil {
+			return fmt.Errorf("make build dir: %w", err)
+		}
+
+		err := b.execute(ctx, b.gitFetchScript(variables))
+		if err == nil {
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return fmt.Errorf("git fetch: %w", err)
+		}
+
+		b.logger.WithError(err).Warnln("git fetch failed")
+		b.trace(fmt.Sprintf("%sFetching changes failed, cloning repository instead%s\n", ansiBoldYellow, ansiReset))
+	}
+
+	if err := os.RemoveAll(b.buildDir); err != nil {
+		return fmt.Errorf("remove build dir: %w", err)
+	}
+
+	if err := os.MkdirAll(b.buildDir, 0o755); err != nil {
+		return fmt.Errorf("make build dir: %w", err)
+	}
+
+	if err := b.execute(ctx, b.gitCloneScript(variables)); err != nil {
+		return fmt.Errorf("git clone: %w", err)
+	}
+
+	return nil
+}
+
+// gitFetchScript returns script which fetches changes into the existing repository.
+func (b *Build) gitFetchScript(variables jobVariables) string {
+	commands := append([]string{echo("Fetching changes...")}, b.gitFetchCommands(variables)...)
+	commands = append(commands, b.gitCheckoutCommands(variables)...)
+
+	return executor.Script{Commands: commands, Quiet: true}.String()
+}
+
+// gitCloneScript returns script which clones the repository into the empty build directory.
+func (b *Build) gitCloneScript(variables jobVariables) string {
+	commands := append([]string{echo("Cloning repository...")}, b.gitFetchCommands(variables)...)
+	commands = append(commands, b.gitCheckoutCommands(variables)...)
+
+	return executor.Script{Commands: commands, Quiet: true}.String()
+}
+
+// gitFetchCommands returns commands which fetch the job refspecs into the repository,
+// the repository is initialized if it does not exist.
+func (b *Build) gitFetchCommands(variables jobVariables) []string {
+	repoURL := executor.Quote(b.job.GitInfo.RepoURL)
+
+	refspecs := b.job.GitInfo.Refspecs
+	if len(refspecs) == 0 {
+		refspecs = defaultGitRefspecs
+	}
+
+	fetch := "git fetch origin --prune --quiet"
+
+	for _, refspec := range refspecs {
+		fetch += " " + executor.Quote(refspec)
+	}
+
+	if depth := b.gitDepth(variables); depth > 0 {
+		fetch += " --depth " + strconv.Itoa(depth)
+	}
+
+	return []string{
+		"git init -q",
+		fmt.Sprintf("git remote set-url origin %s 2>/dev/null || git remote add origin %s", repoURL, repoURL),
+		fetch,
+	}
+}
+
+// gitDepth returns depth of the shallow fetch, GIT_DEPTH variable overrides the job depth.
+func (b *Build) gitDepth(variables jobVariables) int {
+	if value, ok := variables.Get("GIT_DEPTH"); ok {
+		if depth, err := strconv.Atoi(value); err == nil {
+			return depth
+		}
+	}
+
+	return b.job.GitInfo.Depth
+}
+
+// gitCheckoutCommands returns commands which check out the job commit and clean the working tree.
+func (b *Build) gitCheckoutCommands(variables jobVariables) []string {
+	var commands []string
+
+	sha := b.job.GitInfo.Sha
+	if sha == "" {
+		sha, _ = variables.Get("CI_COMMIT_SHA")
+	}
+
+	// LFS objects are pulled after the checkout, so the smudge filter is always skipped.
+	if sha != "" {
+		commands = append(
+			commands,
+			echo("Checking out "+shortSHA(sha)+"..."),
+			"GIT_LFS_SKIP_SMUDGE=1 git checkout -f -q "+executor.Quote(sha),
+		)
+	} else {
+		commands = append(
+			commands,
+			"git remote set-head origin --auto",
+			"GIT_LFS_SKIP_SMUDGE=1 git checkout -f -q origin/HEAD",
+		)
+	}
+
+	if cleanFlags := gitCleanFlags(variables); cleanFlags != "" {
+		commands = append(commands, "git clean "+cleanFlags)
+	}
+
+	if gitLFSEnabled(variables) {
+		commands = append(commands, gitLFSPull)
+	}
+
+	return append(commands, b.gitSubmoduleCommands(variables)...)
+}
+
+// gitSubmoduleCommands returns commands which update submodules according to GIT_SUBMODULE_STRATEGY.
+// Submodules hosted on the same Gitlab are fetched using the job token.
+func (b *Build) gitSubmoduleCommands(variables jobVariables) []string {
+	strategy, _ := variables.Get("GIT_SUBMODULE_STRATEGY")
+
+	var recursive string
+
+	switch strategy {
+	case gitSubmoduleStrategyNormal:
+	case gitSubmoduleStrategyRecursive:
+		recursive = " --recursive"
+	default:
+		return nil
+	}
+
+	git := "git"
+	for _, rewrite := range gitURLRewrites(b.job.GitInfo.RepoURL) {
+		git += " -c " + executor.Quote(rewrite)
+	}
+
+	update := git + " submodule update --init" + recursive
+	if flags, ok := variables.Get("GIT_SUBMODULE_UPDATE_FLAGS"); ok && flags != "" {
+		update += " " + flags
+	}
+
+	commands := []string{
+		echo("Updating/initializing submodules" + recursive + "..."),
+		"git submodule sync" + recursive,
+		"GIT_LFS_SKIP_SMUDGE=1 " + update,
+		"git submodule foreach" + recursive + " 'git reset --hard'",
+	}
+
+	if cleanFlags := gitCleanFlags(variables); cleanFlags != "" {
+		commands = append(commands, "git submodule foreach"+recursive+" "+executor.Quote("git clean "+cleanFlags))
+	}
+
+	if gitLFSEnabled(variables) {
+		commands = append(commands, git+" submodule foreach"+recursive+" "+executor.Quote(gitLFSPull))
+	}
+
+	return commands
+}
+
+// gitURLRewrites returns git configs which rewrite URLs of the Gitlab repositories
+// to the URL with credentials of the job repository.
+func gitURLRewrites(repoURL string) []string {
+	u, err := url.Parse(repoURL)
+	if err != nil || u.User == nil || u.Host == "" {
+		return nil
+	}
+
+	withCredentials := fmt.Sprintf("%s://%s@%s/", u.Scheme, u.User.String(), u.Host)
+
+	return []string{
+		fmt.Sprintf("url.%s.insteadOf=%s://%s/", withCredentials, u.Scheme, u.Host),
+		fmt.Sprintf("url.%s.insteadOf=git@%s:", withCredentials, u.Hostname()),
+		fmt.Sprintf("url.%s.insteadOf=ssh://git@%s/", withCredentials, u.Hostname()),
+	}
+}
+
+// gitCleanFlags returns flags of the git clean, empty if cleaning is disabled.
+func gitCleanFlags(variables jobVariables) string {
+	cleanFlags, ok := variables.Get("GIT_CLEAN_FLAGS")
+	if !ok {
+		return defaultGitCleanFlags
+	}
+
+	if cleanFlags == "none" {
+		return ""
+	}
+
+	return cleanFlags
+}
+
+// gitLFSEnabled reports whether LFS objects must be pulled.
+func gitLFSEnabled(variables jobVariables) bool {
+	skip, _ := variables.Get("GIT_LFS_SKIP_SMUDGE")
+
+	return skip != "1" && skip != "true"
+}
+
+// echo returns command which prints the message.
+func echo(message string) string {
+	return "printf '%s\\n' " + executor.Quote(message)
+}
+
+// shortSHA returns abbreviated commit SHA.
+func shortSHA(sha string) string {
+	const shortSHALength = 8
+
+	if len(sha) <= shortSHALength {
+		return sha
+	}
+
+	return sha[:shortSHALength]
+}
@@ -13,19 +13,45 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/ihippik/gitlab-runner/config"
 )
 
+// jobStatusHeader header in which Gitlab sends the current job state.
+const jobStatusHeader = "Job-Status"
+
+// errArtifactsNotFound returned when the job has no artifacts or they were expired.
+var errArtifactsNotFound = errors.New("artifacts not found")
+
+// traceRangeError returned when the Gitlab has the job trace of another length than the sent offset.
+type traceRangeError struct {
+	// Offset length of the trace stored by the Gitlab.
+	Offset int
+}
+
+// Error implements error.
+func (e *traceRangeError) Error() string {
+	return fmt.Sprintf("trace range mismatch, remote offset %d", e.Offset)
+}
+
+const (
+	// uploadAttempts number of attempts to upload the artifact.
+	uploadAttempts = 3
+	// defaultRetryDelay delay before the first retry, it grows with every attempt.
+	defaultRetryDelay = time.Second
+)
+
 // GitlabAPI represent API for interacting with Gitlab.
 type GitlabAPI struct {
-	basePath string
-	client   *http.Client
+	basePath   string
+	client     *http.Client
+	retryDelay time.Duration
 }
 
 // NewGitlabAPI create new  Gitlab API instance.
 func NewGitlabAPI(client *http.Client, base string) *GitlabAPI {
-	return &GitlabAPI{client: client, basePath: base}
+	return &GitlabAPI{client: client, basePath: base, retryDelay: defaultRetryDelay}
 }
 
 // register register new gitlab-runner.
@@ -117,12 +143,19 @@ func (g GitlabAPI) jobRequest(ctx context.Context, jReq *jobRequest) (*jobRespon
 	return &jobRequest, nil
 }
 
-func (g GitlabAPI) jobTrace(ctx context.Context, startOffset, jobID int, jobToken string, content []byte) (int, error) {
+// jobTrace appends content to the job trace, returns new trace offset and the remote job state.
+func (g GitlabAPI) jobTrace(
+	ctx context.Context,
+	startOffset,
+	jobID int,
+	jobToken string,
+	content []byte,
+) (int, remoteJobState, error) {
 	traceURL := fmt.Sprintf("%s/jobs/%d/trace", g.basePath, jobID)
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, traceURL, bytes.NewReader(content))
 	if err != nil {
-		return 0, fmt.Errorf("new request: %w", err)
+		return 0, "", fmt.Errorf("new request: %w", err)
 	}
 
 	endOffset := startOffset + len(content)
@@ -133,104 +166,188 @@ func (g GitlabAPI) jobTrace(ctx context.Context, startOffset, jobID int, jobToke
 
 	resp, err := g.client.Do(req)
 	if err != nil {
-		return 0, fmt.Errorf("do request: %w", err)
+		return 0, "", fmt.Errorf("do request: %w", err)
 	}
 
 	if err = resp.Body.Close(); err != nil {
-		return 0, fmt.Errorf("close body: %w", err)
+		return 0, "", fmt.Errorf("close body: %w", err)
+	}
+
+	state := remoteJobState(resp.Header.Get(jobStatusHeader))
+
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// the Range header contains the stored part of the trace, e.g. "0-42".
+		var start, end int
+		if _, err := fmt.Sscanf(resp.Header.Get("Range"), "%d-%d", &start, &end); err != nil {
+			return 0, state, fmt.Errorf("invalid range %q: %w", resp.Header.Get("Range"), err)
+		}
+
+		return 0, state, &traceRangeError{Offset: end}
 	}
 
 	if resp.StatusCode != http.StatusAccepted {
-		return 0, fmt.Errorf("invalid status: %s", resp.Status)
+		return 0, state, fmt.Errorf("invalid status: %s", resp.Status)
 	}
 
-	return endOffset, nil
+	return endOffset, state, nil
 }
 
-func (g GitlabAPI) updateJob(ctx context.Context, jobID int, request *updateJobRequest) error {
+// updateJob updates the job state, returns the remote job state.
+func (g GitlabAPI) updateJob(ctx context.Context, jobID int, request *updateJobRequest) (remoteJobState, error) {
 	data, err := json.Marshal(request)
 	if err != nil {
-		return fmt.Errorf("marshal request: %w", err)
+		return "", fmt.Errorf("marshal request: %w", err)
 	}
 
 	updateURL := fmt.Sprintf("%s/jobs/%d", g.basePath, jobID)
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodPut, updateURL, bytes.NewReader(data))
 	if err != nil {
-		return fmt.Errorf("new request: %w", err)
+		return "", fmt.Errorf("new request: %w", err)
 	}
 
 	req.Header.Set("content-type", "application/json")
 
 	resp, err := g.client.Do(req)
 	if err != nil {
-		return fmt.Errorf("do request: %w", err)
+		return "", fmt.Errorf("do request: %w", err)
 	}
 
 	if err = resp.Body.Close(); err != nil {
-		return fmt.Errorf("close body: %w", err)
+		return "", fmt.Errorf("close body: %w", err)
 	}
 
+	state := remoteJobState(resp.Header.Get(jobStatusHeader))
+
 	if resp.StatusCode > http.StatusAccepted {
-		return fmt.Errorf("bad status: %s", resp.Status)
+		return state, fmt.Errorf("bad status: %s", resp.Status)
 	}
 
-	return nil
+	return state, nil
 }
 
-func (g GitlabAPI) uploadArtifacts(ctx context.Context, jobID int, token, path string, options artifactsOptions) error {
+// uploadArtifacts uploads the artifact file streaming it as multipart form,
+// transient failures are retried. onProgress is called with the number of uploaded bytes
+// and the file size, the size is -1 if it is unknown.
+func (g GitlabAPI) uploadArtifacts(
+	ctx context.Context,
+	jobID int,
+	token, path string,
+	options artifactsOptions,
+	onProgress func(uploaded, total int64),
+) error {
+	q := url.Values{}
+
+	if options.ExpireIn != "" {
+		q.Set("expire_in", options.ExpireIn)
+	}
+
+	if options.Format != "" {
+		q.Set("artifact_format", string(options.Format))
+	}
+
+	if options.Type != "" {
+		q.Set("artifact_type", options.Type)
+	}
+
+	uploadURL := fmt.Sprintf("%s/jobs/%d/artifacts?%s", g.basePath, jobID, q.Encode())
+
+	var err error
+
+	for attempt := 1; ; attempt++ {
+		var retry bool
+
+		retry, err = g.uploadFile(ctx, uploadURL, token, path, onProgress)
+		if err == nil || !retry || attempt >= uploadAttempts {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * g.retryDelay):
+		}
+	}
+
+	return err
+}
+
+// uploadFile sends the file as multipart form in a single request, reports whether the failure is transient.
+// The form is streamed through a pipe, Content-Length is set if the file size is known.
+func (g GitlabAPI) uploadFile(
+	ctx context.Context,
+	uploadURL, token, path string,
+	onProgress func(uploaded, total int64),
+) (bool, error) {
 	file, err := os.Open(path)
 	if err != nil {
-		return fmt.Errorf("file open: %w", err)
+		return false, fmt.Errorf("file open: %w", err)
 	}
+	defer file.Close()
 
 	fi, err := file.Stat()
 	if err != nil {
-		return fmt.Errorf("file stat: %w", err)
+		return false, fmt.Errorf("file stat: %w", err)
+	}
+
+	size := int64(-1)
+	if fi.Mode().IsRegular() {
+		size = fi.Size()
 	}
-	defer file.Close()
 
-	body := new(bytes.Buffer)
-	writer := multipart.NewWriter(body)
+	pr, pw := io.Pipe()
+	defer pr.Close()
 
-	part, err := writer.CreateFormFile("file", fi.Name())
+	writer := multipart.NewWriter(pw)
+	content := &progressReader{r: file, total: size, onProgress: onProgress}
+
+	go func() {
+		pw.CloseWithError(writeFormFile(writer, fi.Name(), content))
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uploadURL, pr)
 	if err != nil {
-		return fmt.Errorf("create form file: %w", err)
+		return false, fmt.Errorf("new request: %w", err)
 	}
 
-	if _, err = io.Copy(part, file); err != nil {
-		return fmt.Errorf("copy error: %w", err)
-	}
+	if size >= 0 {
+		overhead, err := formOverhead(writer.Boundary(), fi.Name())
+		if err != nil {
+			return false, fmt.Errorf("form size: %w", err)
+		}
 
-	if err = writer.Close(); err != nil {
-		return fmt.Errorf("close writer: %w", err)
+		req.ContentLength = overhead + size
 	}
 
-	q := url.Values{}
+	req.Header.Set("JOB-TOKEN", token)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
 
-	if options.ExpireIn != "" {
-		q.Set("expire_in", options.ExpireIn)
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, fmt.Errorf("do request: %w", err)
 	}
+	defer resp.Body.Close()
 
-	if options.Format != "" {
-		q.Set("artifact_format", string(options.Format))
-	}
+	if resp.StatusCode > http.StatusNoContent {
+		transient := resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests
 
-	if options.Type != "" {
-		q.Set("artifact_type", options.Type)
+		return transient, fmt.Errorf("bad status: %s", resp.Status)
 	}
 
-	uploadURL := fmt.Sprintf("%s/jobs/%d/artifacts?%s", g.basePath, jobID, q.Encode())
+	return false, nil
+}
+
+// downloadArtifacts downloads artifacts archive of the job into the writer,
+// the token of the job which owns the artifacts is used.
+func (g GitlabAPI) downloadArtifacts(ctx context.Context, jobID int, token string, w io.Writer) error {
+	downloadURL := fmt.Sprintf("%s/jobs/%d/artifacts", g.basePath, jobID)
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uploadURL, body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, downloadURL, nil)
 	if err != nil {
 		return fmt.Errorf("new request: %w", err)
 	}
 
-	headers := make(http.Header)
-	headers.Set("JOB-TOKEN", token)
-	headers.Set("Content-Type", writer.FormDataContentType())
-	req.Header = headers
+	req.Header.Set("JOB-TOKEN", token)
 
 	resp, err := g.client.Do(req)
 	if err != nil {
@@ -238,9 +355,84 @@ func (g GitlabAPI) uploadArtifacts(ctx context.Context, jobID int, token, path s
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode > http.StatusNoContent {
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return errArtifactsNotFound
+	case http.StatusForbidden, http.StatusUnauthorized:
+		return errors.New("forbidden")
+	default:
 		return fmt.Errorf("bad status: %s", resp.Status)
 	}
 
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("read body: %w", err)
+	}
+
 	return nil
 }
+
+// writeFormFile writes the whole multipart form with a single file.
+func writeFormFile(writer *multipart.Writer, name string, r io.Reader) error {
+	part, err := writer.CreateFormFile("file", name)
+	if err != nil {
+		return fmt.Errorf("create form file: %w", err)
+	}
+
+	if _, err = io.Copy(part, r); err != nil {
+		return fmt.Errorf("copy error: %w", err)
+	}
+
+	if err = writer.Close(); err != nil {
+		return fmt.Errorf("close writer: %w", err)
+	}
+
+	return nil
+}
+
+// formOverhead returns size of the multipart form without the file content.
+func formOverhead(boundary, name string) (int64, error) {
+	var counter countWriter
+
+	writer := multipart.NewWriter(&counter)
+	if err := writer.SetBoundary(boundary); err != nil {
+		return 0, err
+	}
+
+	if err := writeFormFile(writer, name, strings.NewReader("")); err != nil {
+		return 0, err
+	}
+
+	return counter.n, nil
+}
+
+// countWriter counts written bytes.
+type countWriter struct {
+	n int64
+}
+
+// Write implements io.Writer.
+func (c *countWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// progressReader reports the number of bytes read from the underlying reader.
+type progressReader struct {
+	r          io.Reader
+	read       int64
+	total      int64
+	onProgress func(uploaded, total int64)
+}
+
+// Read implements io.Reader.
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+
+	if n > 0 && p.onProgress != nil {
+		p.onProgress(p.read, p.total)
+	}
+
+	return n, err
+}
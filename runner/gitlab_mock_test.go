@@ -2,6 +2,7 @@ package runner
 
 import (
 	"context"
+	"io"
 
 	"github.com/stretchr/testify/mock"
 
@@ -17,10 +18,15 @@ func (g *GitlabAPIMock) uploadArtifacts(
 	id int,
 	token, path string,
 	options artifactsOptions,
+	onProgress func(uploaded, total int64),
 ) error {
 	panic("implement me")
 }
 
+func (g *GitlabAPIMock) downloadArtifacts(ctx context.Context, id int, token string, w io.Writer) error {
+	panic("implement me")
+}
+
 func (g *GitlabAPIMock) register(ctx context.Context, token string, cfg *config.RunnerCfg) (string, error) {
 	args := g.Called(ctx, token, cfg)
 	return args.String(0), args.Error(1)
@@ -31,9 +37,9 @@ func (g *GitlabAPIMock) jobRequest(ctx context.Context, req *jobRequest) (*jobRe
 	return args.Get(0).(*jobResponse), args.Error(1)
 }
 
-func (g *GitlabAPIMock) updateJob(ctx context.Context, id int, req *updateJobRequest) error {
+func (g *GitlabAPIMock) updateJob(ctx context.Context, id int, req *updateJobRequest) (remoteJobState, error) {
 	args := g.Called(ctx, id, req)
-	return args.Error(0)
+	return args.Get(0).(remoteJobState), args.Error(1)
 }
 
 func (g *GitlabAPIMock) jobTrace(
@@ -42,7 +48,7 @@ func (g *GitlabAPIMock) jobTrace(
 	jobID int,
 	jobToken string,
 	content []byte,
-) (int, error) {
+) (int, remoteJobState, error) {
 	args := g.Called(ctx, startOffset, jobID, jobToken, content)
-	return args.Int(0), args.Error(1)
+	return args.Int(0), args.Get(1).(remoteJobState), args.Error(2)
 }
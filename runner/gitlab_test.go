@@ -0,0 +1,166 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGitlabAPI_jobStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(jobStatusHeader, string(remoteJobStateCanceled))
+
+		switch r.Method {
+		case http.MethodPatch:
+			assert.Equal(t, "/jobs/2/trace", r.URL.Path)
+			assert.Equal(t, "0-4", r.Header.Get("Content-Range"))
+			w.WriteHeader(http.StatusAccepted)
+		case http.MethodPut:
+			assert.Equal(t, "/jobs/2", r.URL.Path)
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer srv.Close()
+
+	api := NewGitlabAPI(srv.Client(), srv.URL)
+
+	offset, state, err := api.jobTrace(context.Background(), 0, 2, "job-token", []byte("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, offset)
+	assert.True(t, state.isCanceled())
+
+	state, err = api.updateJob(context.Background(), 2, &updateJobRequest{State: "running"})
+	assert.NoError(t, err)
+	assert.Equal(t, remoteJobStateCanceled, state)
+}
+
+func TestGitlabAPI_jobTrace_rangeMismatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Range", "0-3")
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+	}))
+	defer srv.Close()
+
+	api := NewGitlabAPI(srv.Client(), srv.URL)
+
+	_, _, err := api.jobTrace(context.Background(), 5, 2, "job-token", []byte("hello"))
+
+	var rangeErr *traceRangeError
+	if assert.True(t, errors.As(err, &rangeErr)) {
+		assert.Equal(t, 3, rangeErr.Offset)
+	}
+}
+
+func TestGitlabAPI_uploadArtifacts(t *testing.T) {
+	content := bytes.Repeat([]byte("artifact"), 64*1024)
+	path := filepath.Join(t.TempDir(), "artifacts.zip")
+	assert.NoError(t, os.WriteFile(path, content, 0o644))
+
+	var attempts int
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+
+		assert.Equal(t, "/jobs/2/artifacts", r.URL.Path)
+		assert.Equal(t, "zip", r.URL.Query().Get("artifact_format"))
+		assert.Equal(t, "job-token", r.Header.Get("JOB-TOKEN"))
+
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, r.ContentLength, int64(len(body)))
+
+		// the first attempt fails with a transient error.
+		if attempts == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		assert.NoError(t, err)
+
+		part, err := multipart.NewReader(bytes.NewReader(body), params["boundary"]).NextPart()
+		if assert.NoError(t, err) {
+			assert.Equal(t, "artifacts.zip", part.FileName())
+
+			data, err := ioutil.ReadAll(part)
+			assert.NoError(t, err)
+			assert.Equal(t, content, data)
+		}
+
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	api := NewGitlabAPI(srv.Client(), srv.URL)
+	api.retryDelay = time.Millisecond
+
+	var uploaded, total int64
+
+	err := api.uploadArtifacts(
+		context.Background(),
+		2,
+		"job-token",
+		path,
+		artifactsOptions{Format: "zip"},
+		func(n, size int64) { uploaded, total = n, size },
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, int64(len(content)), uploaded)
+	assert.Equal(t, int64(len(content)), total)
+}
+
+func TestGitlabAPI_uploadArtifacts_permanentError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "artifacts.zip")
+	assert.NoError(t, os.WriteFile(path, []byte("artifact"), 0o644))
+
+	var attempts int
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	}))
+	defer srv.Close()
+
+	api := NewGitlabAPI(srv.Client(), srv.URL)
+	api.retryDelay = time.Millisecond
+
+	err := api.uploadArtifacts(context.Background(), 2, "job-token", path, artifactsOptions{}, nil)
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestGitlabAPI_downloadArtifacts(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodGet, r.Method)
+		assert.Equal(t, "dependency-token", r.Header.Get("JOB-TOKEN"))
+
+		switch r.URL.Path {
+		case "/jobs/1/artifacts":
+			_, _ = w.Write([]byte("archive"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	api := NewGitlabAPI(srv.Client(), srv.URL)
+
+	var buf bytes.Buffer
+	assert.NoError(t, api.downloadArtifacts(context.Background(), 1, "dependency-token", &buf))
+	assert.Equal(t, "archive", buf.String())
+
+	err := api.downloadArtifacts(context.Background(), 2, "dependency-token", &buf)
+	assert.True(t, errors.Is(err, errArtifactsNotFound))
+}
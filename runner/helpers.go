@@ -8,3 +8,15 @@ const (
 	ansiBoldBlue   = "\033[34;1m"
 	ansiReset      = "\033[0;m"
 )
+
+// shortTokenLength length of the token part which can be safely shown.
+const shortTokenLength = 8
+
+// shortToken returns the beginning of the token which identifies the runner.
+func shortToken(token string) string {
+	if len(token) <= shortTokenLength {
+		return token
+	}
+
+	return token[:shortTokenLength]
+}
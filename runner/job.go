@@ -1,5 +1,7 @@
 package runner
 
+import "os"
+
 type (
 	step struct {
 		Name         string   `json:"name"`
@@ -28,17 +30,66 @@ type (
 	}
 
 	jobResponse struct {
-		ID            int          `json:"id"`
-		Token         string       `json:"token"`
-		AllowGitFetch bool         `json:"allow_git_fetch"`
-		Variables     jobVariables `json:"variables"`
-		GitInfo       jobGitInfo   `json:"git_info"`
-		Steps         []step       `json:"steps"`
-		Artifacts     []artifact   `json:"artifacts"`
+		ID            int           `json:"id"`
+		Token         string        `json:"token"`
+		AllowGitFetch bool          `json:"allow_git_fetch"`
+		Variables     jobVariables  `json:"variables"`
+		GitInfo       jobGitInfo    `json:"git_info"`
+		RunnerInfo    jobRunnerInfo `json:"runner_info"`
+		Image         jobImage      `json:"image"`
+		Services      []jobService  `json:"services"`
+		Steps         []step        `json:"steps"`
+		Artifacts     []artifact    `json:"artifacts"`
+		Dependencies  []dependency  `json:"dependencies"`
+		Cache         []jobCache    `json:"cache"`
+		CoverageRegex string        `json:"coverage_regex"`
+	}
+
+	jobImage struct {
+		Name string `json:"name"`
+	}
+
+	jobService struct {
+		Name       string       `json:"name"`
+		Alias      string       `json:"alias"`
+		Entrypoint []string     `json:"entrypoint"`
+		Command    []string     `json:"command"`
+		Variables  jobVariables `json:"variables"`
+	}
+
+	jobCache struct {
+		Key          string   `json:"key"`
+		Untracked    bool     `json:"untracked"`
+		Policy       string   `json:"policy"`
+		Paths        []string `json:"paths"`
+		When         string   `json:"when"`
+		FallbackKeys []string `json:"fallback_keys"`
+	}
+
+	dependency struct {
+		ID            int                     `json:"id"`
+		Token         string                  `json:"token"`
+		Name          string                  `json:"name"`
+		ArtifactsFile dependencyArtifactsFile `json:"artifacts_file"`
+	}
+
+	dependencyArtifactsFile struct {
+		Filename string `json:"filename"`
+		Size     int64  `json:"size"`
+	}
+
+	jobRunnerInfo struct {
+		Timeout int `json:"timeout"`
 	}
 
 	jobGitInfo struct {
-		RepoURL string `json:"repo_url"`
+		RepoURL   string   `json:"repo_url"`
+		Ref       string   `json:"ref"`
+		Sha       string   `json:"sha"`
+		BeforeSha string   `json:"before_sha"`
+		RefType   string   `json:"ref_type"`
+		Refspecs  []string `json:"refspecs"`
+		Depth     int      `json:"depth"`
 	}
 
 	jobVariables []jobVariable
@@ -48,6 +99,8 @@ type (
 		Value  string `json:"value"`
 		Public bool   `json:"public"`
 		Masked bool   `json:"masked"`
+		Raw    bool   `json:"raw"`
+		File   bool   `json:"file"`
 	}
 
 	jobRequest struct {
@@ -93,14 +146,43 @@ type (
 	}
 )
 
+// conditions of the step execution, artifacts upload and cache saving.
+const (
+	stepWhenOnSuccess = "on_success"
+	stepWhenOnFailure = "on_failure"
+	stepWhenAlways    = "always"
+)
+
+// available job failure reasons.
+const (
+	failureReasonScript         failureReason = "script_failure"
+	failureReasonRunnerSystem   failureReason = "runner_system_failure"
+	failureReasonJobExecution   failureReason = "job_execution_timeout"
+	failureReasonStuckOrTimeout failureReason = "stuck_or_timeout_failure"
+	failureReasonUnknown        failureReason = "unknown_failure"
+)
+
+// remote job states which are important for the gitlab-runner.
+const (
+	remoteJobStateRunning   remoteJobState = "running"
+	remoteJobStateCanceling remoteJobState = "canceling"
+	remoteJobStateCanceled  remoteJobState = "canceled"
+)
+
 type (
+	failureReason string
+
+	// remoteJobState represent job state on the Gitlab side.
+	remoteJobState string
+
 	updateJobRequest struct {
 		Info          versionInfo    `json:"info,omitempty"`
 		Token         string         `json:"token,omitempty"`
 		State         string         `json:"state,omitempty"`
-		FailureReason string         `json:"failure_reason,omitempty"`
+		FailureReason failureReason  `json:"failure_reason,omitempty"`
 		Output        jobTraceOutput `json:"output,omitempty"`
 		ExitCode      int            `json:"exit_code,omitempty"`
+		Coverage      *float64       `json:"coverage,omitempty"`
 	}
 
 	jobTraceOutput struct {
@@ -110,12 +192,85 @@ type (
 )
 
 // Get find job variable with specified key.
+// The last defined variable wins as it overrides the previous ones.
 func (v jobVariables) Get(key string) (string, bool) {
-	for _, job := range v {
-		if job.Key == key {
-			return job.Value, true
+	for i := len(v) - 1; i >= 0; i-- {
+		if v[i].Key == key {
+			return v[i].Value, true
 		}
 	}
 
 	return "", false
 }
+
+// Expand expands $VAR and ${VAR} references in the variable values in order, using the already expanded
+// values of the previous variables, so PATH=$PATH:/bin appends to the previous value of PATH.
+// The variables which are not defined before are taken from the process environment.
+// Raw variables are left as is, unknown variables are replaced with the empty string.
+func (v jobVariables) Expand() jobVariables {
+	expanded := make(jobVariables, 0, len(v))
+
+	for _, variable := range v {
+		if !variable.Raw {
+			variable.Value = os.Expand(variable.Value, func(key string) string {
+				if value, ok := expanded.Get(key); ok {
+					return value
+				}
+
+				return os.Getenv(key)
+			})
+		}
+
+		expanded = append(expanded, variable)
+	}
+
+	return expanded
+}
+
+// masked returns values of the masked variables.
+func (v jobVariables) masked() []string {
+	var values []string
+
+	for _, variable := range v {
+		if variable.Masked && variable.Value != "" {
+			values = append(values, variable.Value)
+		}
+	}
+
+	return values
+}
+
+// Environ returns variables in KEY=VALUE form.
+func (v jobVariables) Environ() []string {
+	env := make([]string, 0, len(v))
+
+	for _, variable := range v {
+		env = append(env, variable.Key+"="+variable.Value)
+	}
+
+	return env
+}
+
+// isCanceled reports whether the job was canceled on the Gitlab side.
+func (s remoteJobState) isCanceled() bool {
+	return s == remoteJobStateCanceling || s == remoteJobStateCanceled
+}
+
+// shouldRun reports whether the step must be executed according to its condition,
+// steps without condition run only if all the previous steps succeeded.
+func (s step) shouldRun(failed bool) bool {
+	return whenMatches(s.When, failed)
+}
+
+// whenMatches reports whether the condition is met for the job result,
+// empty condition is treated as "on_success".
+func whenMatches(when string, failed bool) bool {
+	switch when {
+	case stepWhenAlways:
+		return true
+	case stepWhenOnFailure:
+		return failed
+	default:
+		return !failed
+	}
+}
@@ -0,0 +1,42 @@
+package runner
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobVariables_Expand(t *testing.T) {
+	variables := jobVariables{
+		{Key: "CI_PROJECT_DIR", Value: "/builds/group/project"},
+		{Key: "OUTPUT", Value: "$CI_PROJECT_DIR/out"},
+		{Key: "RAW", Value: "$CI_PROJECT_DIR", Raw: true},
+		{Key: "BRACES", Value: "${OUTPUT}/bin:${UNKNOWN}"},
+		{Key: "OVERRIDDEN", Value: "first"},
+		{Key: "OVERRIDDEN", Value: "second"},
+		{Key: "REF", Value: "$OVERRIDDEN"},
+		{Key: "PATH", Value: "$PATH:/opt/bin"},
+		{Key: "PATH", Value: "$PATH:/opt/go/bin"},
+		{Key: "FORWARD", Value: "$LATER"},
+		{Key: "LATER", Value: "later"},
+	}
+
+	assert.Equal(
+		t,
+		[]string{
+			"CI_PROJECT_DIR=/builds/group/project",
+			"OUTPUT=/builds/group/project/out",
+			"RAW=$CI_PROJECT_DIR",
+			"BRACES=/builds/group/project/out/bin:",
+			"OVERRIDDEN=first",
+			"OVERRIDDEN=second",
+			"REF=second",
+			"PATH=" + os.Getenv("PATH") + ":/opt/bin",
+			"PATH=" + os.Getenv("PATH") + ":/opt/bin:/opt/go/bin",
+			"FORWARD=",
+			"LATER=later",
+		},
+		variables.Expand().Environ(),
+	)
+}
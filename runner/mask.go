@@ -0,0 +1,134 @@
+package runner
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// maskedValue replacement of the masked values in the job trace.
+const maskedValue = "[MASKED]"
+
+// maskWriter replaces masked values in the data written to the underlying writer.
+// The tail of the data which may be the beginning of a masked value is kept
+// until the next write, so the values split between chunks are masked as well.
+type maskWriter struct {
+	w      io.Writer
+	values [][]byte
+	first  [256]bool
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+// newMaskWriter create new masking writer, encoded forms (URL-encoded, base64) of the values
+// are masked too if withEncoded is set.
+func newMaskWriter(w io.Writer, values []string, withEncoded bool) *maskWriter {
+	m := &maskWriter{w: w}
+
+	seen := make(map[string]struct{})
+	add := func(value string) {
+		if _, ok := seen[value]; ok || value == "" {
+			return
+		}
+
+		seen[value] = struct{}{}
+		m.values = append(m.values, []byte(value))
+		m.first[value[0]] = true
+	}
+
+	for _, value := range values {
+		add(value)
+
+		if withEncoded && value != "" {
+			add(url.QueryEscape(value))
+			add(url.PathEscape(value))
+			add(base64.StdEncoding.EncodeToString([]byte(value)))
+			add(base64.RawStdEncoding.EncodeToString([]byte(value)))
+			add(base64.URLEncoding.EncodeToString([]byte(value)))
+		}
+	}
+
+	// the longest value wins if the values overlap.
+	sort.SliceStable(m.values, func(i, j int) bool {
+		return len(m.values[i]) > len(m.values[j])
+	})
+
+	return m
+}
+
+// Write implements io.Writer.
+func (m *maskWriter) Write(p []byte) (int, error) {
+	if len(m.values) == 0 {
+		return m.w.Write(p)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.buf = append(m.buf, p...)
+
+	out, rest := m.mask(m.buf)
+	m.buf = append(m.buf[:0], rest...)
+
+	if len(out) > 0 {
+		if _, err := m.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// Flush writes the kept tail of the data.
+func (m *maskWriter) Flush() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.buf) == 0 {
+		return nil
+	}
+
+	_, err := m.w.Write(m.buf)
+	m.buf = m.buf[:0]
+
+	return err
+}
+
+// mask returns masked data and the tail which can be the beginning of a masked value.
+func (m *maskWriter) mask(data []byte) ([]byte, []byte) {
+	out := make([]byte, 0, len(data))
+
+LOOP:
+	for i := 0; i < len(data); {
+		if !m.first[data[i]] {
+			out = append(out, data[i])
+			i++
+
+			continue
+		}
+
+		for _, value := range m.values {
+			if bytes.HasPrefix(data[i:], value) {
+				out = append(out, maskedValue...)
+				i += len(value)
+
+				continue LOOP
+			}
+		}
+
+		for _, value := range m.values {
+			if len(data)-i < len(value) && bytes.HasPrefix(value, data[i:]) {
+				return out, data[i:]
+			}
+		}
+
+		out = append(out, data[i])
+		i++
+	}
+
+	return out, nil
+}
@@ -0,0 +1,78 @@
+package runner
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaskWriter(t *testing.T) {
+	tests := []struct {
+		name        string
+		values      []string
+		withEncoded bool
+		chunks      []string
+		want        string
+	}{
+		{
+			name:   "no values",
+			chunks: []string{"secret"},
+			want:   "secret",
+		},
+		{
+			name:   "single chunk",
+			values: []string{"secret"},
+			chunks: []string{"my secret is secret!"},
+			want:   "my [MASKED] is [MASKED]!",
+		},
+		{
+			name:   "split between chunks",
+			values: []string{"secret"},
+			chunks: []string{"my se", "c", "ret is s", "ecret"},
+			want:   "my [MASKED] is [MASKED]",
+		},
+		{
+			name:   "partial tail",
+			values: []string{"secret"},
+			chunks: []string{"not a secre"},
+			want:   "not a secre",
+		},
+		{
+			name:   "overlapping values",
+			values: []string{"pass", "password"},
+			chunks: []string{"password pass"},
+			want:   "[MASKED] [MASKED]",
+		},
+		{
+			name:   "encoded values are ignored",
+			values: []string{"p@ss word"},
+			chunks: []string{"p%40ss+word cEBzcyB3b3Jk"},
+			want:   "p%40ss+word cEBzcyB3b3Jk",
+		},
+		{
+			name:        "encoded values",
+			values:      []string{"p@ss word"},
+			withEncoded: true,
+			chunks:      []string{"p%40ss+word p@ss%20word cEBzcyB3b3Jk"},
+			want:        "[MASKED] [MASKED] [MASKED]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+
+			w := newMaskWriter(&out, tt.values, tt.withEncoded)
+
+			for _, chunk := range tt.chunks {
+				n, err := w.Write([]byte(chunk))
+				assert.NoError(t, err)
+				assert.Equal(t, len(chunk), n)
+			}
+
+			assert.NoError(t, w.Flush())
+			assert.Equal(t, tt.want, out.String())
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package runner
+
+import "sync"
+
+// workerPool limits the number of concurrently processed jobs.
+// Each acquired slot has an identifier which is unique among the busy slots.
+type workerPool struct {
+	mu    sync.Mutex
+	limit int
+	busy  map[int]struct{}
+}
+
+// newWorkerPool create new worker pool with the specified limit (0 means no limit).
+func newWorkerPool(limit int) *workerPool {
+	return &workerPool{
+		limit: limit,
+		busy:  make(map[int]struct{}),
+	}
+}
+
+// acquire takes the lowest free slot, returns false if there are no free slots.
+func (p *workerPool) acquire() (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.limit > 0 && len(p.busy) >= p.limit {
+		return 0, false
+	}
+
+	id := 0
+	for ; ; id++ {
+		if _, ok := p.busy[id]; !ok {
+			break
+		}
+	}
+
+	p.busy[id] = struct{}{}
+
+	return id, true
+}
+
+// release frees the slot with specified identifier.
+func (p *workerPool) release(id int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.busy, id)
+}
+
+// size returns the number of busy slots.
+func (p *workerPool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.busy)
+}
@@ -0,0 +1,39 @@
+package runner
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerPool(t *testing.T) {
+	pool := newWorkerPool(2)
+
+	id, ok := pool.acquire()
+	assert.True(t, ok)
+	assert.Equal(t, 0, id)
+
+	id, ok = pool.acquire()
+	assert.True(t, ok)
+	assert.Equal(t, 1, id)
+
+	_, ok = pool.acquire()
+	assert.False(t, ok)
+	assert.Equal(t, 2, pool.size())
+
+	pool.release(0)
+
+	id, ok = pool.acquire()
+	assert.True(t, ok)
+	assert.Equal(t, 0, id)
+}
+
+func TestWorkerPool_unlimited(t *testing.T) {
+	pool := newWorkerPool(0)
+
+	for i := 0; i < 100; i++ {
+		id, ok := pool.acquire()
+		assert.True(t, ok)
+		assert.Equal(t, i, id)
+	}
+}
@@ -4,29 +4,74 @@ package runner
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
+	"github.com/ihippik/gitlab-runner/cache"
 	"github.com/ihippik/gitlab-runner/config"
+	"github.com/ihippik/gitlab-runner/executor"
 )
 
 // Executor implementation of workers to perform jobs.
+// Prepare is called once before the first command of the job and Cleanup after the last one,
+// the cleanup is not limited by the runner since only the executor knows how long it may take.
+// Execute streams the combined command output into the output writer,
+// non-zero exit status of the command is returned as *executor.ExitError.
 type Executor interface {
-	Execute(ctx context.Context, command string) (string, error)
+	Prepare(ctx context.Context, options executor.Options, output io.Writer) error
+	Execute(ctx context.Context, command string, output io.Writer) error
+	Cleanup(ctx context.Context) error
 	HomeDirectory(dir string)
+	Environment(env []string)
 }
 
+// ExecutorFactory creates a new Executor instance for each build.
+type ExecutorFactory func() Executor
+
+// defaultBuildsDir directory in which build directories are created.
+const defaultBuildsDir = "builds"
+
+// kinds of the executors which are important for the gitlab-runner.
+const (
+	// executorKindDocker kind of the executor which runs the jobs in containers of their images.
+	executorKindDocker = "docker"
+	// executorKindSSH kind of the executor which runs the jobs on another machine over SSH.
+	executorKindSSH = "ssh"
+	// executorKindCustom kind of the executor which runs the jobs in the environment of the user-provided executables.
+	executorKindCustom = "custom"
+)
+
+// isRemoteExecutor reports whether the executor of the kind runs the scripts on another machine,
+// where the build directory of the runner is not available.
+func isRemoteExecutor(kind string) bool {
+	return kind == executorKindSSH || kind == executorKindCustom
+}
+
+// defaultConcurrent default number of concurrently processed jobs.
+const defaultConcurrent = 1
+
 // gitlabAPI presents an interface for working with tasks through API Gitlab.
 type gitlabAPI interface {
 	register(ctx context.Context, token string, cfg *config.RunnerCfg) (string, error)
 	jobRequest(ctx context.Context, req *jobRequest) (*jobResponse, error)
-	updateJob(ctx context.Context, id int, req *updateJobRequest) error
-	uploadArtifacts(ctx context.Context, id int, token, path string, options artifactsOptions) error
-	jobTrace(ctx context.Context, startOffset, jobID int, jobToken string, content []byte) (int, error)
+	updateJob(ctx context.Context, id int, req *updateJobRequest) (remoteJobState, error)
+	uploadArtifacts(
+		ctx context.Context,
+		id int,
+		token, path string,
+		options artifactsOptions,
+		onProgress func(uploaded, total int64),
+	) error
+	downloadArtifacts(ctx context.Context, id int, token string, w io.Writer) error
+	jobTrace(ctx context.Context, startOffset, jobID int, jobToken string, content []byte) (int, remoteJobState, error)
 }
 
 // Service represent main service struct.
@@ -34,22 +79,62 @@ type Service struct {
 	logger *logrus.Entry
 	config *config.Config
 
-	gitlab   gitlabAPI
-	executor Executor
+	gitlab       gitlabAPI
+	newExecutor  ExecutorFactory
+	cacheBackend cache.Backend
+
+	errChan   chan error
+	buildsDir string
+	cleaner   *buildsCleaner
+	// cleanupMu is held exclusively while the build directories are cleaned up,
+	// so the new builds do not start in the directories which are being removed.
+	cleanupMu sync.RWMutex
 
-	errChan     chan error
-	traceOffset int
-	homeDir     string
+	globalPool *workerPool
+	runnerPool *workerPool
+	wg         sync.WaitGroup
+
+	mu     sync.Mutex
+	builds map[int]*Build
 }
 
 // NewService create new Service instance.
-func NewService(logger *logrus.Entry, config *config.Config, gitlab gitlabAPI, executor Executor) *Service {
+func NewService(
+	logger *logrus.Entry,
+	config *config.Config,
+	gitlab gitlabAPI,
+	newExecutor ExecutorFactory,
+) *Service {
+	concurrent := config.Concurrent
+	if concurrent <= 0 {
+		concurrent = defaultConcurrent
+	}
+
+	buildsDir := config.Runner.BuildsDir
+	if buildsDir == "" {
+		buildsDir = defaultBuildsDir
+	}
+
+	if dir, err := filepath.Abs(buildsDir); err == nil {
+		buildsDir = dir
+	}
+
 	return &Service{
-		logger:   logger,
-		config:   config,
-		gitlab:   gitlab,
-		executor: executor,
-		errChan:  make(chan error, 1),
+		logger:       logger,
+		config:       config,
+		gitlab:       gitlab,
+		newExecutor:  newExecutor,
+		cacheBackend: newCacheBackend(logger, config.Runner),
+		errChan:      make(chan error, 1),
+		buildsDir:    buildsDir,
+		cleaner: newBuildsCleaner(
+			logger,
+			config.Runner.Cleanup,
+			filepath.Join(buildsDir, shortToken(config.Runner.Token)),
+		),
+		globalPool: newWorkerPool(concurrent),
+		runnerPool: newWorkerPool(config.Runner.Limit),
+		builds:     make(map[int]*Build),
 	}
 }
 
@@ -82,7 +167,7 @@ LOOP:
 	for {
 		select {
 		case <-jobTicker.C:
-			go s.processJob(ctx)
+			s.startWorker(ctx)
 		case err := <-s.errChan:
 			s.logger.Errorln(err)
 		case <-sigs:
@@ -92,181 +177,148 @@ LOOP:
 		}
 	}
 
+	s.waitWorkers()
 	s.logger.Infoln("let the force be with you")
 
 	return nil
 }
 
-func (s *Service) processJob(ctx context.Context) {
-	// if job received status changed from pending to running
-	job, err := s.gitlab.jobRequest(ctx, &jobRequest{Token: s.config.Runner.Token})
-	if err != nil {
-		s.errChan <- fmt.Errorf("job request: %w", err)
-
+// startWorker starts processing of a new job if there is a free slot in the worker pools.
+func (s *Service) startWorker(ctx context.Context) {
+	globalID, ok := s.globalPool.acquire()
+	if !ok {
+		s.logger.WithField("busy", s.globalPool.size()).Debugln("concurrent limit reached")
 		return
 	}
 
-	if job == nil {
-		s.logger.Debugln("no job")
+	concurrentID, ok := s.runnerPool.acquire()
+	if !ok {
+		s.globalPool.release(globalID)
+		s.logger.WithField("busy", s.runnerPool.size()).Debugln("runner limit reached")
+
 		return
 	}
 
-	s.logger.WithFields(logrus.Fields{
-		"id":          job.ID,
-		"token":       job.Token,
-		"steps_count": len(job.Steps),
-	}).Infoln("get job")
+	s.wg.Add(1)
 
-	helloStr := fmt.Sprintf("Runner %s%s%s greets you!\n", ansiBoldBlue, s.config.Runner.Name, ansiReset)
-	s.trace(ctx, helloStr, job)
-	s.trace(ctx, "I'm getting started.\n", job)
+	go func() {
+		defer s.wg.Done()
+		defer s.globalPool.release(globalID)
+		defer s.runnerPool.release(concurrentID)
 
-	if err := s.process(ctx, job); err != nil {
-		if err := s.jobFailed(ctx, job, err.Error()); err != nil {
-			s.errChan <- fmt.Errorf("process: job failed: %w", err)
-			return
-		}
+		s.processJob(ctx, concurrentID)
+	}()
+}
 
-		s.errChan <- fmt.Errorf("job process: %w", err)
+// waitWorkers waits for the running jobs to finish while logging their errors.
+func (s *Service) waitWorkers() {
+	done := make(chan struct{})
 
-		return
-	}
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
 
-	if err := s.jobFinished(ctx, job); err != nil {
-		s.errChan <- fmt.Errorf("job finished: %w", err)
+	for {
+		select {
+		case err := <-s.errChan:
+			s.logger.Errorln(err)
+		case <-done:
+			return
+		}
 	}
 }
 
-// trace add job trace.
-func (s *Service) trace(ctx context.Context, message string, job *jobResponse) {
-	var err error
-
-	s.traceOffset, err = s.gitlab.jobTrace(ctx, s.traceOffset, job.ID, job.Token, []byte(message))
+func (s *Service) processJob(ctx context.Context, concurrentID int) {
+	// if job received status changed from pending to running
+	job, err := s.gitlab.jobRequest(ctx, &jobRequest{Info: s.versionInfo(), Token: s.config.Runner.Token})
 	if err != nil {
-		s.logger.WithError(err).Errorln("job trace error")
-	}
-}
+		s.errChan <- fmt.Errorf("job request: %w", err)
 
-// jobFinished set job success state.
-func (s *Service) jobFinished(ctx context.Context, job *jobResponse) error {
-	succeeded := fmt.Sprintf("%sJob succeeded!%s", ansiBoldGreen, ansiReset)
-	s.trace(ctx, succeeded, job)
-
-	if err := s.gitlab.updateJob(
-		ctx,
-		job.ID,
-		&updateJobRequest{
-			Token:    job.Token,
-			State:    "success",
-			ExitCode: 0,
-		},
-	); err != nil {
-		return err
+		return
 	}
 
-	s.logger.WithField("job_id", job.ID).Infoln("job was finished")
+	if job == nil {
+		s.logger.Debugln("no job")
+		return
+	}
 
-	return nil
-}
+	s.logger.WithFields(logrus.Fields{
+		"id":            job.ID,
+		"token":         job.Token,
+		"steps_count":   len(job.Steps),
+		"concurrent_id": concurrentID,
+	}).Infoln("get job")
 
-// jobFailed set job failed state.
-func (s *Service) jobFailed(ctx context.Context, job *jobResponse, desc string) error {
-	var err error
+	build := newBuild(s.logger, s.config.Runner, s.gitlab, s.newExecutor(), job, s.buildsDir, concurrentID)
+	build.cacheBackend = s.cacheBackend
 
-	msg := fmt.Sprintf("%sjob failed: %s%s", ansiBoldRed, desc, ansiReset)
+	s.addBuild(build)
+	defer s.removeBuild(build)
 
-	s.traceOffset, err = s.gitlab.jobTrace(ctx, s.traceOffset, job.ID, job.Token, []byte(msg))
-	if err != nil {
-		s.logger.WithError(err).Errorln("job trace error")
+	if err := build.Run(ctx); err != nil {
+		s.errChan <- err
 	}
+}
 
-	if err := s.gitlab.updateJob(
-		ctx,
-		job.ID,
-		&updateJobRequest{
-			Token:         job.Token,
-			State:         "failed",
-			FailureReason: "script_failure",
-			ExitCode:      1,
+// versionInfo returns information about the runner and its supported features.
+// The artifacts and caches are handled in the build directory of the runner,
+// so they are not supported by the remote executors.
+func (s *Service) versionInfo() versionInfo {
+	local := !isRemoteExecutor(s.config.Runner.Executor)
+
+	return versionInfo{
+		Name:         "gitlab-runner",
+		Platform:     runtime.GOOS,
+		Architecture: runtime.GOARCH,
+		Executor:     s.config.Runner.Executor,
+		Shell:        "bash",
+		Features: featuresInfo{
+			Variables:      true,
+			RawVariables:   true,
+			Image:          s.config.Runner.Executor == executorKindDocker,
+			Services:       s.config.Runner.Executor == executorKindDocker,
+			Cancelable:     true,
+			Masking:        true,
+			Refspecs:       true,
+			ReturnExitCode: true,
+
+			Artifacts:               local,
+			ArtifactsExclude:        local,
+			UploadMultipleArtifacts: local,
+			Cache:                   local,
 		},
-	); err != nil {
-		return err
 	}
-
-	s.logger.WithField("job_id", job.ID).Warnln("job failed")
-
-	return nil
 }
 
-func (s *Service) prepare(ctx context.Context, gitURL string) error {
-	const tmpDir = "/home/hippik"
+// addBuild registers the build as running.
+func (s *Service) addBuild(build *Build) {
+	s.cleanupMu.RLock()
+	defer s.cleanupMu.RUnlock()
 
-	dir, err := os.MkdirTemp(tmpDir, "gitlab-runner")
-	if err != nil {
-		return fmt.Errorf("make tmp dir error: %w", err)
-	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	s.homeDir = dir
-
-	out, err := s.executor.Execute(ctx, fmt.Sprintf("git clone %s %s", gitURL, dir))
-	if err != nil {
-		return fmt.Errorf("git clone error: %w(%s)", err, out)
-	}
-
-	s.executor.HomeDirectory(dir)
-
-	s.logger.WithFields(logrus.Fields{"url": gitURL, "dir": dir}).Infoln("repository was cloned")
-
-	return nil
+	s.builds[build.job.ID] = build
 }
 
-// process processes all steps of the job.
-func (s *Service) process(ctx context.Context, job *jobResponse) error {
-	if err := s.prepare(ctx, job.GitInfo.RepoURL); err != nil {
-		return fmt.Errorf("prepare error: %w", err)
-	}
-
-	s.trace(ctx, "Running scripts:\n", job)
+// removeBuild removes the build from the running builds and cleans up the build directories.
+// The cleanup walks the builds tree, so it does not block the running builds, only the start of the new ones.
+// The builds finishing concurrently are cleaned up one by one.
+func (s *Service) removeBuild(build *Build) {
+	s.cleanupMu.Lock()
+	defer s.cleanupMu.Unlock()
 
-	for _, step := range job.Steps {
-		for _, script := range step.Script {
-			// TODO (k.makarov): use timeout from job response.
-			output, err := s.executor.Execute(ctx, script)
-			if err != nil {
-				return fmt.Errorf("%s: %w(%s)", step.Name, err, output)
-			}
+	s.mu.Lock()
 
-			traceStep := fmt.Sprintf("%s%s%s: %s\n", ansiBoldYellow, script, ansiReset, output)
-			s.trace(ctx, traceStep, job)
-		}
+	delete(s.builds, build.job.ID)
 
-		if err := s.upload(ctx, job); err != nil {
-			s.logger.WithError(err).Errorln("upload artefacts error")
-
-			return fmt.Errorf("upload artefact: %w", err)
-		}
-
-		s.logger.WithFields(
-			logrus.Fields{"step_name": step.Name, "scripts_count": len(step.Script)},
-		).Infoln("step was processed")
+	active := make(map[string]struct{}, len(s.builds))
+	for _, b := range s.builds {
+		active[b.buildDir] = struct{}{}
 	}
 
-	return nil
-}
-
-func (s *Service) upload(ctx context.Context, job *jobResponse) error {
-	for _, aItem := range job.Artifacts {
-		for _, path := range aItem.Paths {
-			aPath := s.homeDir + "/" + path
-
-			if err := s.gitlab.uploadArtifacts(ctx, job.ID, job.Token, aPath, aItem.artifactsOptions); err != nil {
-				return err
-			}
+	s.mu.Unlock()
 
-			traceUpload := fmt.Sprintf("%supload%s: %s\n", ansiBoldYellow, ansiReset, path)
-			s.trace(ctx, traceUpload, job)
-		}
-	}
-
-	return nil
+	s.cleaner.clean(build, active)
 }
@@ -3,6 +3,7 @@ package runner
 import (
 	"context"
 	"errors"
+	"runtime"
 	"testing"
 
 	"github.com/sirupsen/logrus"
@@ -11,6 +12,7 @@ import (
 	"github.com/stretchr/testify/mock"
 
 	"github.com/ihippik/gitlab-runner/config"
+	"github.com/ihippik/gitlab-runner/executor"
 )
 
 func TestService_Registration(t *testing.T) {
@@ -136,6 +138,9 @@ func TestService_processJob(t *testing.T) {
 		config *config.Config
 	}
 
+	// the script exit status, declared before the executor mock shadows the package name.
+	scriptFailure := &executor.ExitError{Code: 2}
+
 	logger, _ := test.NewNullLogger()
 	gitlab := new(GitlabAPIMock)
 	executor := new(ExecutorMock)
@@ -145,7 +150,7 @@ func TestService_processJob(t *testing.T) {
 	}
 
 	setUpdateJob := func(id int, req *updateJobRequest, err error) {
-		gitlab.On("updateJob", mock.Anything, id, req).Return(err).Once()
+		gitlab.On("updateJob", mock.Anything, id, req).Return(remoteJobStateRunning, err).Once()
 	}
 
 	setJobTrace := func(startOffset, jobID int, jobToken string, content []byte, result int, err error) {
@@ -156,214 +161,83 @@ func TestService_processJob(t *testing.T) {
 			jobID,
 			jobToken,
 			content,
-		).Return(result, err).Once()
+		).Return(result, remoteJobStateRunning, err).Once()
 	}
 
-	setExecutor := func(command, output string, err error) {
-		executor.On("Execute", mock.Anything, command).Return(output, err).Once()
+	setExecutor := func(commands []string, output string, err error) {
+		executor.On("Execute", mock.Anything, stepScript(step{Script: commands})).Return(output, err).Once()
 	}
 
-	tests := []struct {
-		name            string
-		wantTraceOffset int
-		wantError       error
-		fields          fields
-		setup           func()
-	}{
-		{
-			name: "success",
-			fields: fields{
-				config: &config.Config{
-					Runner: &config.RunnerCfg{
-						Name:     "my-gitlab-runner",
-						URL:      "",
-						Token:    "my-token",
-						Executor: "",
-						Tags:     nil,
-						Interval: 0,
-					},
-				},
-			},
-			wantTraceOffset: 40,
-			setup: func() {
-				setJobRequest(
-					&jobRequest{Token: "my-token"},
-					&jobResponse{
-						ID:    2,
-						Token: "job-token",
-						Steps: []step{
-							{
-								Name:         "step-name",
-								Script:       []string{"command"},
-								Timeout:      0,
-								When:         "",
-								AllowFailure: false,
-							},
-						},
-					},
-					nil,
-				)
-
-				setJobTrace(
-					0,
-					2,
-					"job-token",
-					[]byte{
-						0x52,
-						0x75,
-						0x6e,
-						0x6e,
-						0x65,
-						0x72,
-						0x20,
-						0x1b,
-						0x5b,
-						0x33,
-						0x34,
-						0x3b,
-						0x31,
-						0x6d,
-						0x6d,
-						0x79,
-						0x2d,
-						0x72,
-						0x75,
-						0x6e,
-						0x6e,
-						0x65,
-						0x72,
-						0x1b,
-						0x5b,
-						0x30,
-						0x3b,
-						0x6d,
-						0x20,
-						0x67,
-						0x72,
-						0x65,
-						0x65,
-						0x74,
-						0x73,
-						0x20,
-						0x79,
-						0x6f,
-						0x75,
-						0x21,
-						0xa,
-					},
-					10,
-					nil,
-				)
+	// the whole trace is buffered and sent at once before the job state update.
+	setTrace := func(content string) {
+		greetings := "Runner \x1b[34;1mmy-gitlab-runner\x1b[0;m greets you!\nI'm getting started.\n"
+		setJobTrace(0, 2, "job-token", []byte(greetings+content), len(greetings+content), nil)
+	}
 
-				setJobTrace(
-					10,
-					2,
-					"job-token",
-					[]byte{
-						0x49,
-						0x27,
-						0x6d,
-						0x20,
-						0x67,
-						0x65,
-						0x74,
-						0x74,
-						0x69,
-						0x6e,
-						0x67,
-						0x20,
-						0x73,
-						0x74,
-						0x61,
-						0x72,
-						0x74,
-						0x65,
-						0x64,
-						0x2e,
-						0xa,
-					},
-					20,
-					nil,
-				)
+	job := &jobResponse{
+		ID:    2,
+		Token: "job-token",
+		Steps: []step{
+			{
+				Name:         "step-name",
+				Script:       []string{"command"},
+				Timeout:      0,
+				When:         "",
+				AllowFailure: false,
+			},
+		},
+	}
 
-				setExecutor("command", "hello!", nil)
+	cfg := &config.Config{
+		Runner: &config.RunnerCfg{
+			Name:     "my-gitlab-runner",
+			URL:      "",
+			Token:    "my-token",
+			Executor: "",
+			Tags:     nil,
+			Interval: 0,
+		},
+	}
 
-				setJobTrace(
-					20,
-					2,
-					"job-token",
-					[]byte{
-						0x1b,
-						0x5b,
-						0x33,
-						0x33,
-						0x3b,
-						0x31,
-						0x6d,
-						0x73,
-						0x74,
-						0x65,
-						0x70,
-						0x2d,
-						0x6e,
-						0x61,
-						0x6d,
-						0x65,
-						0x1b,
-						0x5b,
-						0x30,
-						0x3b,
-						0x6d,
-						0x3a,
-						0x20,
-						0x68,
-						0x65,
-						0x6c,
-						0x6c,
-						0x6f,
-						0x21,
-						0xa,
-					},
-					30,
-					nil,
-				)
+	jobReq := &jobRequest{
+		Info: versionInfo{
+			Name:         "gitlab-runner",
+			Platform:     runtime.GOOS,
+			Architecture: runtime.GOARCH,
+			Shell:        "bash",
+			Features: featuresInfo{
+				Variables:      true,
+				RawVariables:   true,
+				Cancelable:     true,
+				Masking:        true,
+				Refspecs:       true,
+				ReturnExitCode: true,
+
+				Artifacts:               true,
+				ArtifactsExclude:        true,
+				UploadMultipleArtifacts: true,
+				Cache:                   true,
+			},
+		},
+		Token: "my-token",
+	}
 
-				setJobTrace(
-					30,
-					2,
-					"job-token",
-					[]byte{
-						0x1b,
-						0x5b,
-						0x33,
-						0x32,
-						0x3b,
-						0x31,
-						0x6d,
-						0x4a,
-						0x6f,
-						0x62,
-						0x20,
-						0x73,
-						0x75,
-						0x63,
-						0x63,
-						0x65,
-						0x65,
-						0x64,
-						0x65,
-						0x64,
-						0x21,
-						0x1b,
-						0x5b,
-						0x30,
-						0x3b,
-						0x6d,
-					},
-					40,
-					nil,
+	tests := []struct {
+		name      string
+		wantError error
+		fields    fields
+		setup     func()
+	}{
+		{
+			name:   "success",
+			fields: fields{config: cfg},
+			setup: func() {
+				setJobRequest(jobReq, job, nil)
+				expectLifecycle(executor)
+				setExecutor([]string{"command"}, "hello!\n", nil)
+				setTrace(
+					"Running scripts:\nhello!\n\x1b[32;1mJob succeeded!\x1b[0;m",
 				)
-
 				setUpdateJob(
 					2,
 					&updateJobRequest{
@@ -378,183 +252,32 @@ func TestService_processJob(t *testing.T) {
 			},
 		},
 		{
-			name: "request jobs error",
-			fields: fields{
-				config: &config.Config{
-					Runner: &config.RunnerCfg{
-						Name:     "my-gitlab-runner",
-						URL:      "",
-						Token:    "my-token",
-						Executor: "",
-						Tags:     nil,
-						Interval: 0,
-					},
-				},
-			},
-			wantError:       errors.New("job request: some error"),
-			wantTraceOffset: 0,
+			name:      "request jobs error",
+			fields:    fields{config: cfg},
+			wantError: errors.New("job request: some error"),
 			setup: func() {
-				setJobRequest(
-					&jobRequest{Token: "my-token"},
-					&jobResponse{
-						ID:    2,
-						Token: "job-token",
-						Steps: []step{
-							{
-								Name:         "step-name",
-								Script:       []string{"command"},
-								Timeout:      0,
-								When:         "",
-								AllowFailure: false,
-							},
-						},
-					},
-					errors.New("some error"),
-				)
+				setJobRequest(jobReq, job, errors.New("some error"))
 			},
 		},
 		{
-			name: "no job",
-			fields: fields{
-				config: &config.Config{
-					Runner: &config.RunnerCfg{
-						Name:     "my-gitlab-runner",
-						URL:      "",
-						Token:    "my-token",
-						Executor: "",
-						Tags:     nil,
-						Interval: 0,
-					},
-				},
-			},
-			wantTraceOffset: 0,
+			name:   "no job",
+			fields: fields{config: cfg},
 			setup: func() {
-				setJobRequest(
-					&jobRequest{Token: "my-token"},
-					nil,
-					nil,
-				)
+				setJobRequest(jobReq, nil, nil)
 			},
 		},
 		{
-			name: "executor error",
-			fields: fields{
-				config: &config.Config{
-					Runner: &config.RunnerCfg{
-						Name:     "my-gitlab-runner",
-						URL:      "",
-						Token:    "my-token",
-						Executor: "",
-						Tags:     nil,
-						Interval: 0,
-					},
-				},
-			},
-			wantError:       errors.New("job process: step-name: some err"),
-			wantTraceOffset: 20,
+			name:      "executor error",
+			fields:    fields{config: cfg},
+			wantError: errors.New("job process: step-name: exit status 2"),
 			setup: func() {
-				setJobRequest(
-					&jobRequest{Token: "my-token"},
-					&jobResponse{
-						ID:    2,
-						Token: "job-token",
-						Steps: []step{
-							{
-								Name:         "step-name",
-								Script:       []string{"command"},
-								Timeout:      0,
-								When:         "",
-								AllowFailure: false,
-							},
-						},
-					},
-					nil,
+				setJobRequest(jobReq, job, nil)
+				expectLifecycle(executor)
+				setExecutor([]string{"command"}, "hello!\n", scriptFailure)
+				setTrace(
+					"Running scripts:\nhello!\n" +
+						"\x1b[31;1mjob failed: step-name: exit status 2\x1b[0;m",
 				)
-
-				setJobTrace(
-					0,
-					2,
-					"job-token",
-					[]byte{
-						0x52,
-						0x75,
-						0x6e,
-						0x6e,
-						0x65,
-						0x72,
-						0x20,
-						0x1b,
-						0x5b,
-						0x33,
-						0x34,
-						0x3b,
-						0x31,
-						0x6d,
-						0x6d,
-						0x79,
-						0x2d,
-						0x72,
-						0x75,
-						0x6e,
-						0x6e,
-						0x65,
-						0x72,
-						0x1b,
-						0x5b,
-						0x30,
-						0x3b,
-						0x6d,
-						0x20,
-						0x67,
-						0x72,
-						0x65,
-						0x65,
-						0x74,
-						0x73,
-						0x20,
-						0x79,
-						0x6f,
-						0x75,
-						0x21,
-						0xa,
-					},
-					10,
-					nil,
-				)
-
-				setJobTrace(
-					10,
-					2,
-					"job-token",
-					[]byte{
-						0x49,
-						0x27,
-						0x6d,
-						0x20,
-						0x67,
-						0x65,
-						0x74,
-						0x74,
-						0x69,
-						0x6e,
-						0x67,
-						0x20,
-						0x73,
-						0x74,
-						0x61,
-						0x72,
-						0x74,
-						0x65,
-						0x64,
-						0x2e,
-						0xa,
-					},
-					20,
-					nil,
-				)
-
-				setExecutor("command", "hello!", errors.New("some err"))
-
 				setUpdateJob(
 					2,
 					&updateJobRequest{
@@ -562,131 +285,24 @@ func TestService_processJob(t *testing.T) {
 						State:         "failed",
 						FailureReason: "script_failure",
 						Output:        jobTraceOutput{},
-						ExitCode:      1,
+						ExitCode:      2,
 					},
 					nil,
 				)
 			},
 		},
 		{
-			name: "executor error: job failed",
-			fields: fields{
-				config: &config.Config{
-					Runner: &config.RunnerCfg{
-						Name:     "my-gitlab-runner",
-						URL:      "",
-						Token:    "my-token",
-						Executor: "",
-						Tags:     nil,
-						Interval: 0,
-					},
-				},
-			},
-			wantError:       errors.New("process: job failed: some update job err"),
-			wantTraceOffset: 20,
+			name:      "executor error: job failed",
+			fields:    fields{config: cfg},
+			wantError: errors.New("process: job failed: some update job err"),
 			setup: func() {
-				setJobRequest(
-					&jobRequest{Token: "my-token"},
-					&jobResponse{
-						ID:    2,
-						Token: "job-token",
-						Steps: []step{
-							{
-								Name:         "step-name",
-								Script:       []string{"command"},
-								Timeout:      0,
-								When:         "",
-								AllowFailure: false,
-							},
-						},
-					},
-					nil,
-				)
-
-				setJobTrace(
-					0,
-					2,
-					"job-token",
-					[]byte{
-						0x52,
-						0x75,
-						0x6e,
-						0x6e,
-						0x65,
-						0x72,
-						0x20,
-						0x1b,
-						0x5b,
-						0x33,
-						0x34,
-						0x3b,
-						0x31,
-						0x6d,
-						0x6d,
-						0x79,
-						0x2d,
-						0x72,
-						0x75,
-						0x6e,
-						0x6e,
-						0x65,
-						0x72,
-						0x1b,
-						0x5b,
-						0x30,
-						0x3b,
-						0x6d,
-						0x20,
-						0x67,
-						0x72,
-						0x65,
-						0x65,
-						0x74,
-						0x73,
-						0x20,
-						0x79,
-						0x6f,
-						0x75,
-						0x21,
-						0xa,
-					},
-					10,
-					nil,
-				)
-
-				setJobTrace(
-					10,
-					2,
-					"job-token",
-					[]byte{
-						0x49,
-						0x27,
-						0x6d,
-						0x20,
-						0x67,
-						0x65,
-						0x74,
-						0x74,
-						0x69,
-						0x6e,
-						0x67,
-						0x20,
-						0x73,
-						0x74,
-						0x61,
-						0x72,
-						0x74,
-						0x65,
-						0x64,
-						0x2e,
-						0xa,
-					},
-					20,
-					nil,
+				setJobRequest(jobReq, job, nil)
+				expectLifecycle(executor)
+				setExecutor([]string{"command"}, "hello!\n", scriptFailure)
+				setTrace(
+					"Running scripts:\nhello!\n" +
+						"\x1b[31;1mjob failed: step-name: exit status 2\x1b[0;m",
 				)
-
-				setExecutor("command", "hello!", errors.New("some err"))
-
 				setUpdateJob(
 					2,
 					&updateJobRequest{
@@ -694,207 +310,23 @@ func TestService_processJob(t *testing.T) {
 						State:         "failed",
 						FailureReason: "script_failure",
 						Output:        jobTraceOutput{},
-						ExitCode:      1,
+						ExitCode:      2,
 					},
 					errors.New("some update job err"),
 				)
 			},
 		},
 		{
-			name: "success: update job error",
-			fields: fields{
-				config: &config.Config{
-					Runner: &config.RunnerCfg{
-						Name:     "my-gitlab-runner",
-						URL:      "",
-						Token:    "my-token",
-						Executor: "",
-						Tags:     nil,
-						Interval: 0,
-					},
-				},
-			},
-			wantError:       errors.New("job finished: some err"),
-			wantTraceOffset: 40,
+			name:      "success: update job error",
+			fields:    fields{config: cfg},
+			wantError: errors.New("job finished: some err"),
 			setup: func() {
-				setJobRequest(
-					&jobRequest{Token: "my-token"},
-					&jobResponse{
-						ID:    2,
-						Token: "job-token",
-						Steps: []step{
-							{
-								Name:         "step-name",
-								Script:       []string{"command"},
-								Timeout:      0,
-								When:         "",
-								AllowFailure: false,
-							},
-						},
-					},
-					nil,
-				)
-
-				setJobTrace(
-					0,
-					2,
-					"job-token",
-					[]byte{
-						0x52,
-						0x75,
-						0x6e,
-						0x6e,
-						0x65,
-						0x72,
-						0x20,
-						0x1b,
-						0x5b,
-						0x33,
-						0x34,
-						0x3b,
-						0x31,
-						0x6d,
-						0x6d,
-						0x79,
-						0x2d,
-						0x72,
-						0x75,
-						0x6e,
-						0x6e,
-						0x65,
-						0x72,
-						0x1b,
-						0x5b,
-						0x30,
-						0x3b,
-						0x6d,
-						0x20,
-						0x67,
-						0x72,
-						0x65,
-						0x65,
-						0x74,
-						0x73,
-						0x20,
-						0x79,
-						0x6f,
-						0x75,
-						0x21,
-						0xa,
-					},
-					10,
-					nil,
+				setJobRequest(jobReq, job, nil)
+				expectLifecycle(executor)
+				setExecutor([]string{"command"}, "hello!\n", nil)
+				setTrace(
+					"Running scripts:\nhello!\n\x1b[32;1mJob succeeded!\x1b[0;m",
 				)
-
-				setJobTrace(
-					10,
-					2,
-					"job-token",
-					[]byte{
-						0x49,
-						0x27,
-						0x6d,
-						0x20,
-						0x67,
-						0x65,
-						0x74,
-						0x74,
-						0x69,
-						0x6e,
-						0x67,
-						0x20,
-						0x73,
-						0x74,
-						0x61,
-						0x72,
-						0x74,
-						0x65,
-						0x64,
-						0x2e,
-						0xa,
-					},
-					20,
-					nil,
-				)
-
-				setExecutor("command", "hello!", nil)
-
-				setJobTrace(
-					20,
-					2,
-					"job-token",
-					[]byte{
-						0x1b,
-						0x5b,
-						0x33,
-						0x33,
-						0x3b,
-						0x31,
-						0x6d,
-						0x73,
-						0x74,
-						0x65,
-						0x70,
-						0x2d,
-						0x6e,
-						0x61,
-						0x6d,
-						0x65,
-						0x1b,
-						0x5b,
-						0x30,
-						0x3b,
-						0x6d,
-						0x3a,
-						0x20,
-						0x68,
-						0x65,
-						0x6c,
-						0x6c,
-						0x6f,
-						0x21,
-						0xa,
-					},
-					30,
-					nil,
-				)
-
-				setJobTrace(
-					30,
-					2,
-					"job-token",
-					[]byte{
-						0x1b,
-						0x5b,
-						0x33,
-						0x32,
-						0x3b,
-						0x31,
-						0x6d,
-						0x4a,
-						0x6f,
-						0x62,
-						0x20,
-						0x73,
-						0x75,
-						0x63,
-						0x63,
-						0x65,
-						0x65,
-						0x64,
-						0x65,
-						0x64,
-						0x21,
-						0x1b,
-						0x5b,
-						0x30,
-						0x3b,
-						0x6d,
-					},
-					40,
-					nil,
-				)
-
 				setUpdateJob(
 					2,
 					&updateJobRequest{
@@ -917,15 +349,19 @@ func TestService_processJob(t *testing.T) {
 			defer gitlab.AssertExpectations(t)
 			defer executor.AssertExpectations(t)
 
+			buildsDir := t.TempDir()
+
 			s := &Service{
 				logger:      logrus.NewEntry(logger),
 				config:      tt.fields.config,
 				gitlab:      gitlab,
-				executor:    executor,
+				newExecutor: func() Executor { return executor },
 				errChan:     make(chan error, 100),
-				traceOffset: 0,
+				buildsDir:   buildsDir,
+				cleaner:     newBuildsCleaner(logrus.NewEntry(logger), config.CleanupCfg{}, buildsDir),
+				builds:      make(map[int]*Build),
 			}
-			s.processJob(context.Background())
+			s.processJob(context.Background(), 0)
 			select {
 			case err := <-s.errChan:
 				if assert.NotNil(t, tt.wantError) {
@@ -935,7 +371,7 @@ func TestService_processJob(t *testing.T) {
 				assert.NoError(t, tt.wantError)
 			}
 
-			assert.Equal(t, tt.wantTraceOffset, s.traceOffset)
+			assert.Empty(t, s.builds)
 		})
 	}
 }
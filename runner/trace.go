@@ -0,0 +1,236 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultTraceFlushInterval default interval between sending of the trace chunks.
+	defaultTraceFlushInterval = 3 * time.Second
+	// defaultTraceFlushSize default size of the buffered trace after which it is sent immediately.
+	defaultTraceFlushSize = 64 * 1024
+	// maxTraceRetryDelay limits the growing delay between the attempts to send the trace after failures.
+	maxTraceRetryDelay = time.Minute
+	// maxTraceBufferSize size of the unsent trace after which the new output is dropped.
+	maxTraceBufferSize = 4 * 1024 * 1024
+)
+
+// traceDroppedMessage appended to the trace once the output starts being dropped.
+const traceDroppedMessage = "\n[the job trace is not accepted by the Gitlab, the output is dropped]\n"
+
+// traceWriter buffers job trace and sends it to the Gitlab in incremental chunks
+// on the flush interval or when the buffer exceeds the flush size.
+// Failed chunks are retried with a growing delay and the output is dropped
+// while the Gitlab does not accept the trace for too long.
+// Writing stops as soon as the Gitlab reports that the job was canceled.
+type traceWriter struct {
+	ctx      context.Context
+	gitlab   gitlabAPI
+	jobID    int
+	token    string
+	onCancel func()
+
+	flushInterval time.Duration
+	flushSize     int
+
+	sendMu sync.Mutex
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	offset   int
+	canceled bool
+	dropping bool
+	failures int
+	retryAt  time.Time
+}
+
+// newTraceWriter create new trace writer for the specified job.
+func newTraceWriter(
+	ctx context.Context,
+	gitlab gitlabAPI,
+	job *jobResponse,
+	flushInterval time.Duration,
+	flushSize int,
+	onCancel func(),
+) *traceWriter {
+	if flushInterval <= 0 {
+		flushInterval = defaultTraceFlushInterval
+	}
+
+	if flushSize <= 0 {
+		flushSize = defaultTraceFlushSize
+	}
+
+	return &traceWriter{
+		ctx:           ctx,
+		gitlab:        gitlab,
+		jobID:         job.ID,
+		token:         job.Token,
+		onCancel:      onCancel,
+		flushInterval: flushInterval,
+		flushSize:     flushSize,
+		done:          make(chan struct{}),
+	}
+}
+
+// Start starts periodic sending of the buffered trace.
+func (t *traceWriter) Start() {
+	t.wg.Add(1)
+
+	go func() {
+		defer t.wg.Done()
+
+		ticker := time.NewTicker(t.flushInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-t.done:
+				return
+			case <-ticker.C:
+				// errors are not fatal, the chunk will be sent with the next flush.
+				_ = t.flush(false)
+			}
+		}
+	}()
+}
+
+// Write implements io.Writer and appends data to the job trace buffer.
+func (t *traceWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+
+	if t.canceled {
+		t.mu.Unlock()
+		return len(p), nil
+	}
+
+	switch {
+	case t.buf.Len() < maxTraceBufferSize:
+		t.buf.Write(p)
+	case !t.dropping:
+		t.buf.WriteString(traceDroppedMessage)
+		t.dropping = true
+	}
+
+	full := t.buf.Len() >= t.flushSize
+	t.mu.Unlock()
+
+	if full {
+		// errors are not fatal, the chunk will be sent with the next flush.
+		_ = t.flush(false)
+	}
+
+	return len(p), nil
+}
+
+// Flush sends the buffered trace to the Gitlab immediately.
+func (t *traceWriter) Flush() error {
+	return t.flush(true)
+}
+
+// flush sends the buffered trace to the Gitlab, unless forced it waits for the retry delay after failures.
+func (t *traceWriter) flush(force bool) error {
+	t.sendMu.Lock()
+	defer t.sendMu.Unlock()
+
+	t.mu.Lock()
+	if t.canceled || t.buf.Len() == 0 || (!force && time.Now().Before(t.retryAt)) {
+		t.mu.Unlock()
+		return nil
+	}
+
+	chunk := make([]byte, t.buf.Len())
+	copy(chunk, t.buf.Bytes())
+	t.buf.Reset()
+	offset := t.offset
+	t.mu.Unlock()
+
+	newOffset, state, err := t.gitlab.jobTrace(t.ctx, offset, t.jobID, t.token, chunk)
+	if state.isCanceled() {
+		t.mu.Lock()
+		t.canceled = true
+		t.mu.Unlock()
+
+		t.onCancel()
+
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err != nil {
+		var rangeErr *traceRangeError
+		if errors.As(err, &rangeErr) {
+			// continue from the offset of the Gitlab, the part of the chunk it already has is not sent again.
+			skip := rangeErr.Offset - offset
+			if skip < 0 {
+				skip = 0
+			} else if skip > len(chunk) {
+				skip = len(chunk)
+			}
+
+			chunk = chunk[skip:]
+			t.offset = rangeErr.Offset
+		} else {
+			t.failures++
+			t.retryAt = time.Now().Add(t.retryDelay())
+		}
+
+		// put the chunk back in front of the data written in the meantime.
+		data := append(chunk, t.buf.Bytes()...)
+		t.buf.Reset()
+		t.buf.Write(data)
+
+		return fmt.Errorf("job trace: %w", err)
+	}
+
+	t.offset = newOffset
+	t.failures = 0
+	t.retryAt = time.Time{}
+	t.dropping = false
+
+	return nil
+}
+
+// retryDelay returns the delay before the next attempt, it doubles with every failure.
+func (t *traceWriter) retryDelay() time.Duration {
+	delay := t.flushInterval
+	for i := 1; i < t.failures && delay < maxTraceRetryDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > maxTraceRetryDelay {
+		delay = maxTraceRetryDelay
+	}
+
+	return delay
+}
+
+// Close stops periodic sending and flushes the rest of the trace.
+func (t *traceWriter) Close() error {
+	select {
+	case <-t.done:
+	default:
+		close(t.done)
+	}
+
+	t.wg.Wait()
+
+	return t.Flush()
+}
+
+// Offset returns current trace offset.
+func (t *traceWriter) Offset() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.offset
+}
@@ -0,0 +1,136 @@
+package runner
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestTraceWriter_flushSize(t *testing.T) {
+	gitlab := new(GitlabAPIMock)
+	defer gitlab.AssertExpectations(t)
+
+	gitlab.On("jobTrace", mock.Anything, 0, 1, "job-token", []byte("hello")).
+		Return(5, remoteJobStateRunning, nil).
+		Once()
+	gitlab.On("jobTrace", mock.Anything, 5, 1, "job-token", []byte("!")).
+		Return(6, remoteJobStateRunning, nil).
+		Once()
+
+	job := &jobResponse{ID: 1, Token: "job-token"}
+	tracer := newTraceWriter(context.Background(), gitlab, job, time.Hour, 4, func() {})
+	tracer.Start()
+
+	_, err := tracer.Write([]byte("hel"))
+	assert.NoError(t, err)
+	_, err = tracer.Write([]byte("lo"))
+	assert.NoError(t, err)
+	_, err = tracer.Write([]byte("!"))
+	assert.NoError(t, err)
+
+	assert.Equal(t, 5, tracer.Offset())
+	assert.NoError(t, tracer.Close())
+	assert.Equal(t, 6, tracer.Offset())
+}
+
+func TestTraceWriter_flushInterval(t *testing.T) {
+	gitlab := &gitlabTraceFake{state: remoteJobStateRunning, traces: make(map[int][]byte)}
+	job := &jobResponse{ID: 1, Token: "job-token"}
+
+	tracer := newTraceWriter(context.Background(), gitlab, job, 10*time.Millisecond, 1024, func() {})
+	tracer.Start()
+
+	defer tracer.Close()
+
+	_, err := tracer.Write([]byte("hello"))
+	assert.NoError(t, err)
+
+	deadline := time.Now().Add(time.Second)
+	for tracer.Offset() != 5 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, 5, tracer.Offset())
+}
+
+func TestTraceWriter_retry(t *testing.T) {
+	gitlab := new(GitlabAPIMock)
+	defer gitlab.AssertExpectations(t)
+
+	gitlab.On("jobTrace", mock.Anything, 0, 1, "job-token", []byte("hello")).
+		Return(0, remoteJobState(""), assert.AnError).
+		Once()
+	gitlab.On("jobTrace", mock.Anything, 0, 1, "job-token", []byte("hello world")).
+		Return(11, remoteJobStateRunning, nil).
+		Once()
+
+	job := &jobResponse{ID: 1, Token: "job-token"}
+	tracer := newTraceWriter(context.Background(), gitlab, job, time.Hour, 1024, func() {})
+
+	_, err := tracer.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.Error(t, tracer.Flush())
+
+	_, err = tracer.Write([]byte(" world"))
+	assert.NoError(t, err)
+	assert.NoError(t, tracer.Flush())
+	assert.Equal(t, 11, tracer.Offset())
+}
+
+func TestTraceWriter_rangeMismatch(t *testing.T) {
+	gitlab := new(GitlabAPIMock)
+	defer gitlab.AssertExpectations(t)
+
+	// the Gitlab already has the beginning of the chunk.
+	gitlab.On("jobTrace", mock.Anything, 0, 1, "job-token", []byte("hello")).
+		Return(0, remoteJobStateRunning, &traceRangeError{Offset: 3}).
+		Once()
+	gitlab.On("jobTrace", mock.Anything, 3, 1, "job-token", []byte("lo")).
+		Return(5, remoteJobStateRunning, nil).
+		Once()
+
+	job := &jobResponse{ID: 1, Token: "job-token"}
+	tracer := newTraceWriter(context.Background(), gitlab, job, time.Hour, 1024, func() {})
+
+	_, err := tracer.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.Error(t, tracer.Flush())
+	assert.Equal(t, 3, tracer.Offset())
+
+	assert.NoError(t, tracer.Flush())
+	assert.Equal(t, 5, tracer.Offset())
+}
+
+func TestTraceWriter_backoff(t *testing.T) {
+	gitlab := new(GitlabAPIMock)
+	defer gitlab.AssertExpectations(t)
+
+	gitlab.On("jobTrace", mock.Anything, 0, 1, "job-token", mock.Anything).
+		Return(0, remoteJobState(""), assert.AnError).
+		Once()
+
+	job := &jobResponse{ID: 1, Token: "job-token"}
+	tracer := newTraceWriter(context.Background(), gitlab, job, time.Hour, 4, func() {})
+
+	// the failed chunk is not sent again on the writes until the retry delay passes.
+	_, err := tracer.Write([]byte("hello"))
+	assert.NoError(t, err)
+	_, err = tracer.Write([]byte(" world"))
+	assert.NoError(t, err)
+
+	// the output is dropped once the unsent trace is too big.
+	_, err = tracer.Write(make([]byte, maxTraceBufferSize))
+	assert.NoError(t, err)
+	_, err = tracer.Write([]byte("dropped"))
+	assert.NoError(t, err)
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+
+	assert.Equal(t, len("hello world")+maxTraceBufferSize+len(traceDroppedMessage), tracer.buf.Len())
+	assert.True(t, strings.HasSuffix(tracer.buf.String(), traceDroppedMessage))
+}